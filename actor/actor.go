@@ -0,0 +1,352 @@
+package actor
+
+import (
+	"errors"
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/metrics"
+	"github.com/name5566/leaf/timer"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("actor not found")
+	ErrExists   = errors.New("actor already exists")
+	ErrClosed   = errors.New("actor system closed")
+)
+
+// System runs actors identified by IDs. Every actor has its own mailbox,
+// the messages of an actor are handled one at a time in order, and at most
+// Workers actors handle messages at the same time, so a slow actor holds
+// one worker and never stalls the others
+type System struct {
+	// labels the metrics of the system, no metrics are exported if empty
+	Name       string
+	Workers    int
+	MailboxLen int
+	// 0 disables the timers and the asynchronous calls of the actors
+	TimerDispatcherLen int
+	AsynCallLen        int
+	AsynCallTimeout    time.Duration
+	mutex              sync.Mutex
+	actors             map[interface{}]*Actor
+	creating           map[interface{}]bool
+	workers            chan struct{}
+	wg                 sync.WaitGroup
+	closed             bool
+}
+
+// one actor per goroutine (goroutine not safe), the methods of an actor
+// must be called by its own handlers
+type Actor struct {
+	ID interface{}
+	// called in the goroutine of the actor when it is destroyed
+	OnDestroy  func()
+	system     *System
+	server     *chanrpc.Server
+	client     *chanrpc.Client
+	dispatcher *timer.Dispatcher
+	closeSig   chan bool
+}
+
+func (s *System) Init() {
+	if s.Workers <= 0 {
+		panic("invalid Workers")
+	}
+	if s.MailboxLen < 0 {
+		s.MailboxLen = 0
+		log.Release("invalid MailboxLen, reset to %v", s.MailboxLen)
+	}
+	if s.TimerDispatcherLen < 0 {
+		s.TimerDispatcherLen = 0
+		log.Release("invalid TimerDispatcherLen, reset to %v", s.TimerDispatcherLen)
+	}
+	if s.AsynCallLen < 0 {
+		s.AsynCallLen = 0
+		log.Release("invalid AsynCallLen, reset to %v", s.AsynCallLen)
+	}
+
+	s.actors = make(map[interface{}]*Actor)
+	s.creating = make(map[interface{}]bool)
+	s.workers = make(chan struct{}, s.Workers)
+
+	if s.Name != "" {
+		metrics.NewGaugeFunc("leaf_actors",
+			"Number of running actors.",
+			func() float64 { return float64(s.NumActor()) },
+			"system", s.Name)
+		metrics.NewGaugeFunc("leaf_actor_busy_workers",
+			"Number of workers handling a message.",
+			func() float64 { return float64(len(s.workers)) },
+			"system", s.Name)
+	}
+}
+
+// init runs before the actor handles any message, it registers the
+// handlers of the actor
+//
+// goroutine safe
+func (s *System) Create(id interface{}, init func(a *Actor)) (*Actor, error) {
+	a := &Actor{
+		ID:         id,
+		system:     s,
+		server:     chanrpc.NewServer(s.MailboxLen),
+		client:     chanrpc.NewClient(s.AsynCallLen),
+		dispatcher: timer.NewDispatcher(s.TimerDispatcherLen),
+		closeSig:   make(chan bool, 1),
+	}
+	a.client.AsynCallTimeout = s.AsynCallTimeout
+
+	// the ID is reserved while init runs
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil, ErrClosed
+	}
+	if _, ok := s.actors[id]; ok || s.creating[id] {
+		s.mutex.Unlock()
+		return nil, ErrExists
+	}
+	s.creating[id] = true
+	s.mutex.Unlock()
+
+	if init != nil {
+		init(a)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.creating, id)
+	if s.closed {
+		a.dispatcher.Close()
+		return nil, ErrClosed
+	}
+	s.actors[id] = a
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		a.run()
+	}()
+	return a, nil
+}
+
+// the messages already in the mailbox fail with "chanrpc server closed"
+//
+// goroutine safe
+func (s *System) Destroy(id interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	a := s.actors[id]
+	if a == nil {
+		return ErrNotFound
+	}
+	delete(s.actors, id)
+	a.closeSig <- true
+	return nil
+}
+
+// goroutine safe
+func (s *System) Get(id interface{}) *Actor {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.actors[id]
+}
+
+// goroutine safe
+func (s *System) NumActor() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.actors)
+}
+
+// the mailbox of the actor, nil if not found, e.g. for Skeleton.AsynCall
+//
+// goroutine safe
+func (s *System) Server(id interface{}) *chanrpc.Server {
+	a := s.Get(id)
+	if a == nil {
+		return nil
+	}
+	return a.server
+}
+
+// destroys every actor and waits for them to exit
+func (s *System) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	for id, a := range s.actors {
+		delete(s.actors, id)
+		a.closeSig <- true
+	}
+	s.mutex.Unlock()
+
+	s.wg.Wait()
+	if s.Name != "" {
+		metrics.Unregister("leaf_actors", "system", s.Name)
+		metrics.Unregister("leaf_actor_busy_workers", "system", s.Name)
+	}
+}
+
+// goroutine safe, like chanrpc.Server.Go the message is dropped if the
+// actor is not found
+func (s *System) Go(to interface{}, id interface{}, args ...interface{}) {
+	server := s.Server(to)
+	if server == nil {
+		return
+	}
+	server.Go(id, args...)
+}
+
+// goroutine safe, but an actor must use Actor.Call0
+func (s *System) Call0(to interface{}, id interface{}, args ...interface{}) error {
+	server := s.Server(to)
+	if server == nil {
+		return ErrNotFound
+	}
+	return server.Call0(id, args...)
+}
+
+// goroutine safe, but an actor must use Actor.Call1
+func (s *System) Call1(to interface{}, id interface{}, args ...interface{}) (interface{}, error) {
+	server := s.Server(to)
+	if server == nil {
+		return nil, ErrNotFound
+	}
+	return server.Call1(id, args...)
+}
+
+// goroutine safe, but an actor must use Actor.CallN
+func (s *System) CallN(to interface{}, id interface{}, args ...interface{}) ([]interface{}, error) {
+	server := s.Server(to)
+	if server == nil {
+		return nil, ErrNotFound
+	}
+	return server.CallN(id, args...)
+}
+
+func (a *Actor) acquire() {
+	a.system.workers <- struct{}{}
+}
+
+func (a *Actor) release() {
+	<-a.system.workers
+}
+
+func (a *Actor) run() {
+	for {
+		select {
+		case <-a.closeSig:
+			a.dispatcher.Close()
+			a.server.Close()
+			// the worker is not held while waiting for the replies, the
+			// receivers may need it
+			for !a.client.Idle() {
+				ri := <-a.client.ChanAsynRet
+				a.acquire()
+				a.client.Cb(ri)
+				a.release()
+			}
+			if a.OnDestroy != nil {
+				a.acquire()
+				a.OnDestroy()
+				a.release()
+			}
+			return
+		case ri := <-a.client.ChanAsynRet:
+			a.acquire()
+			a.client.Cb(ri)
+			a.release()
+		case ci := <-a.server.ChanCall:
+			a.acquire()
+			a.server.Exec(ci)
+			a.release()
+		case t := <-a.dispatcher.ChanTimer:
+			a.acquire()
+			t.Cb()
+			a.release()
+		}
+	}
+}
+
+// you must call the function in init
+func (a *Actor) Register(id interface{}, f interface{}) {
+	a.server.Register(id, f)
+}
+
+// the mailbox of the actor
+func (a *Actor) Server() *chanrpc.Server {
+	return a.server
+}
+
+func (a *Actor) AfterFunc(d time.Duration, cb func()) *timer.Timer {
+	if a.system.TimerDispatcherLen == 0 {
+		panic("invalid TimerDispatcherLen")
+	}
+
+	return a.dispatcher.AfterFunc(d, cb)
+}
+
+func (a *Actor) CronFunc(cronExpr *timer.CronExpr, cb func()) *timer.Cron {
+	if a.system.TimerDispatcherLen == 0 {
+		panic("invalid TimerDispatcherLen")
+	}
+
+	return a.dispatcher.CronFunc(cronExpr, cb)
+}
+
+// the worker is released while the mailbox of the receiver is full
+func (a *Actor) Go(to interface{}, id interface{}, args ...interface{}) {
+	a.release()
+	defer a.acquire()
+	a.system.Go(to, id, args...)
+}
+
+// the worker is released while waiting, an actor calling itself deadlocks
+func (a *Actor) Call0(to interface{}, id interface{}, args ...interface{}) error {
+	a.release()
+	defer a.acquire()
+	return a.system.Call0(to, id, args...)
+}
+
+// the worker is released while waiting, an actor calling itself deadlocks
+func (a *Actor) Call1(to interface{}, id interface{}, args ...interface{}) (interface{}, error) {
+	a.release()
+	defer a.acquire()
+	return a.system.Call1(to, id, args...)
+}
+
+// the worker is released while waiting, an actor calling itself deadlocks
+func (a *Actor) CallN(to interface{}, id interface{}, args ...interface{}) ([]interface{}, error) {
+	a.release()
+	defer a.acquire()
+	return a.system.CallN(to, id, args...)
+}
+
+// the callback is the last argument and runs in the goroutine of a
+func (a *Actor) AsynCall(to interface{}, id interface{}, args ...interface{}) {
+	if a.system.AsynCallLen == 0 {
+		panic("invalid AsynCallLen")
+	}
+
+	server := a.system.Server(to)
+	if server == nil {
+		if len(args) < 1 {
+			panic("callback function not found")
+		}
+		a.client.AsynCallFunc(func(done func(interface{}, error)) {
+			done(nil, ErrNotFound)
+		}, args[len(args)-1])
+		return
+	}
+
+	a.client.Attach(server)
+	a.client.AsynCall(id, args...)
+}
+
+// goroutine safe
+func (a *Actor) Destroy() {
+	a.system.Destroy(a.ID)
+}
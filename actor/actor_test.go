@@ -0,0 +1,78 @@
+package actor_test
+
+import (
+	"github.com/name5566/leaf/actor"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// a destroyed actor waits for its replies without holding the only worker
+func TestDestroyPendingAsynCall(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		s := &actor.System{Workers: 1, MailboxLen: 10, AsynCallLen: 10}
+		s.Init()
+		s.Create("b", func(a *actor.Actor) {
+			a.Register("echo", func(args []interface{}) interface{} {
+				return args[0]
+			})
+		})
+		replied := make(chan interface{}, 1)
+		s.Create("a", func(a *actor.Actor) {
+			a.Register("start", func(args []interface{}) {
+				a.AsynCall("b", "echo", 1, func(ret interface{}, err error) {
+					replied <- ret
+				})
+				s.Destroy("a")
+			})
+		})
+		s.Go("a", "start")
+
+		select {
+		case ret := <-replied:
+			if ret != 1 {
+				t.Fatalf("reply %v", ret)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("deadlock")
+		}
+		s.Close()
+	}
+}
+
+func TestCreateExists(t *testing.T) {
+	s := &actor.System{Workers: 1}
+	s.Init()
+	defer s.Close()
+
+	if _, err := s.Create(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	_, err := s.Create(1, func(a *actor.Actor) {
+		called = true
+	})
+	if err != actor.ErrExists || called {
+		t.Fatalf("Create: %v, init called: %v", err, called)
+	}
+}
+
+// the timers of a destroyed actor do not block forever on a full dispatcher
+func TestTimerAfterDestroy(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	s := &actor.System{Workers: 1, TimerDispatcherLen: 1}
+	s.Init()
+	s.Create(1, func(a *actor.Actor) {
+		for i := 0; i < 10; i++ {
+			a.AfterFunc(10*time.Millisecond, func() {})
+		}
+	})
+	s.Destroy(1)
+	s.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("%v goroutines left", n-before)
+	}
+}
@@ -0,0 +1,60 @@
+package actor_test
+
+import (
+	"fmt"
+	"github.com/name5566/leaf/actor"
+)
+
+func Example() {
+	s := &actor.System{
+		Workers:     2,
+		MailboxLen:  10,
+		AsynCallLen: 10,
+	}
+	s.Init()
+
+	// player 1 counts the messages
+	_, err := s.Create(1, func(a *actor.Actor) {
+		n := 0
+		a.Register("hello", func(args []interface{}) interface{} {
+			n++
+			return fmt.Sprintf("hello %v from %v (%v)", args[0], a.ID, n)
+		})
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// player 2 asks player 1
+	done := make(chan bool)
+	s.Create(2, func(a *actor.Actor) {
+		a.Register("greet", func(args []interface{}) {
+			a.AsynCall(1, "hello", a.ID, func(ret interface{}, err error) {
+				fmt.Println(ret, err)
+				a.AsynCall(3, "hello", a.ID, func(ret interface{}, err error) {
+					fmt.Println(ret, err)
+					done <- true
+				})
+			})
+		})
+	})
+
+	s.Go(2, "greet")
+	<-done
+
+	ret, err := s.Call1(1, "hello", "main")
+	fmt.Println(ret, err)
+
+	s.Destroy(1)
+	_, err = s.Call1(1, "hello", "main")
+	fmt.Println(err)
+
+	s.Close()
+
+	// Output:
+	// hello 2 from 1 (1) <nil>
+	// <nil> actor not found
+	// hello main from 1 (2) <nil>
+	// actor not found
+}
@@ -1,13 +1,18 @@
 package chanrpc
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/name5566/leaf/conf"
 	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/metrics"
 	"runtime"
+	"time"
 )
 
+var ErrTimeout = errors.New("chanrpc call timeout")
+
 // one server per goroutine (goroutine not safe)
 // one client per goroutine (goroutine not safe)
 type Server struct {
@@ -17,17 +22,29 @@ type Server struct {
 	// func(args []interface{})
 	// func(args []interface{}) interface{}
 	// func(args []interface{}) []interface{}
+	// func(args []interface{}) (interface{}, error) (see RegisterTyped)
 	functions map[interface{}]interface{}	// 用于保存注册rpc函数
 	ChanCall  chan *CallInfo					// 用于接收rpc调用chan
+	stats     *serverStats
+	gauge     string
 }
 
 type CallInfo struct {
+	id      interface{}
 	f       interface{}		//rpc调用的函数
 	args    []interface{}		//参数
 	chanRet chan *RetInfo		//传递ret的chan
 	cb      interface{}		//保存上下文中的Call back函数
 }
 
+func (ci *CallInfo) ID() interface{} {
+	return ci.id
+}
+
+func (ci *CallInfo) Args() []interface{} {
+	return ci.args
+}
+
 type RetInfo struct {
 	// nil
 	// interface{}
@@ -46,6 +63,8 @@ type Client struct {
 	chanSyncRet     chan *RetInfo		//同步调用时候，用于接收ret的chan
 	ChanAsynRet     chan *RetInfo		//异步调用时，用于接收ret和cb的chan
 	pendingAsynCall int					//异步调用的计步器
+	// 0 means AsynCall never times out
+	AsynCallTimeout time.Duration
 }
 // 初始化一个Server结构
 func NewServer(l int) *Server {
@@ -73,6 +92,11 @@ func (s *Server) Register(id interface{}, f interface{}) {
 	default:
 		panic(fmt.Sprintf("function id %v: definition of function is invalid", id))
 	}
+
+	s.register(id, f)
+}
+
+func (s *Server) register(id interface{}, f interface{}) {
 	// 判断id是否已经注册过
 	if _, ok := s.functions[id]; ok {
 		panic(fmt.Sprintf("function id %v: already registered", id))
@@ -99,8 +123,19 @@ func (s *Server) ret(ci *CallInfo, ri *RetInfo) (err error) {
 }
 
 func (s *Server) exec(ci *CallInfo) (err error) {
+	var callErr error
+	var panicked bool
+	if s.stats != nil {
+		start := time.Now()
+		s.stats.sampleQueue(len(s.ChanCall))
+		defer func() {
+			s.stats.record(ci, time.Since(start), err != nil || callErr != nil, panicked)
+		}()
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
+			panicked = true
 			if conf.LenStackBuf > 0 {
 				buf := make([]byte, conf.LenStackBuf)
 				l := runtime.Stack(buf, false)
@@ -124,6 +159,10 @@ func (s *Server) exec(ci *CallInfo) (err error) {
 	case func([]interface{}) []interface{}:
 		ret := ci.f.(func([]interface{}) []interface{})(ci.args)
 		return s.ret(ci, &RetInfo{ret: ret})
+	case func([]interface{}) (interface{}, error):
+		var ret interface{}
+		ret, callErr = ci.f.(func([]interface{}) (interface{}, error))(ci.args)
+		return s.ret(ci, &RetInfo{ret: ret, err: callErr})
 	}
 
 	panic("bug")
@@ -149,6 +188,7 @@ func (s *Server) Go(id interface{}, args ...interface{}) {
 	}()
 
 	s.ChanCall <- &CallInfo{
+		id:   id,
 		f:    f,
 		args: args,
 	}
@@ -169,10 +209,28 @@ func (s *Server) CallN(id interface{}, args ...interface{}) ([]interface{}, erro
 	return s.Open(0).CallN(id, args...)
 }
 
+// goroutine safe
+func (s *Server) Call0Context(ctx context.Context, id interface{}, args ...interface{}) error {
+	return s.Open(0).Call0Context(ctx, id, args...)
+}
+
+// goroutine safe
+func (s *Server) Call1Context(ctx context.Context, id interface{}, args ...interface{}) (interface{}, error) {
+	return s.Open(0).Call1Context(ctx, id, args...)
+}
+
+// goroutine safe
+func (s *Server) CallNContext(ctx context.Context, id interface{}, args ...interface{}) ([]interface{}, error) {
+	return s.Open(0).CallNContext(ctx, id, args...)
+}
+
 // 向将chancall关闭
 // 处理chancall中剩余的rpc调用。并不会执行而是执行返回错误。
 func (s *Server) Close() {
 	close(s.ChanCall)
+	if s.gauge != "" {
+		metrics.Unregister("leaf_chanrpc_queue_length", "server", s.gauge)
+	}
 
 	for ci := range s.ChanCall {
 		s.ret(ci, &RetInfo{
@@ -241,7 +299,12 @@ func (c *Client) f(id interface{}, n int) (f interface{}, err error) {
 	case 0:
 		_, ok = f.(func([]interface{}))
 	case 1:
-		_, ok = f.(func([]interface{}) interface{})
+		switch f.(type) {
+		case func([]interface{}) interface{}:
+			ok = true
+		case func([]interface{}) (interface{}, error):
+			ok = true
+		}
 	case 2:
 		_, ok = f.(func([]interface{}) []interface{})
 	default:
@@ -265,6 +328,7 @@ func (c *Client) Call0(id interface{}, args ...interface{}) error {
 	}
 
 	err = c.call(&CallInfo{
+		id:      id,
 		f:       f,
 		args:    args,
 		chanRet: c.chanSyncRet,
@@ -284,6 +348,7 @@ func (c *Client) Call1(id interface{}, args ...interface{}) (interface{}, error)
 	}
 
 	err = c.call(&CallInfo{
+		id:      id,
 		f:       f,
 		args:    args,
 		chanRet: c.chanSyncRet,
@@ -303,6 +368,7 @@ func (c *Client) CallN(id interface{}, args ...interface{}) ([]interface{}, erro
 	}
 
 	err = c.call(&CallInfo{
+		id:      id,
 		f:       f,
 		args:    args,
 		chanRet: c.chanSyncRet,
@@ -315,26 +381,113 @@ func (c *Client) CallN(id interface{}, args ...interface{}) ([]interface{}, erro
 	return assert(ri.ret), ri.err
 }
 
+func (c *Client) callContext(ctx context.Context, id interface{}, f interface{}, args []interface{}) (ri *RetInfo, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+
+	// a late return must not be seen by the next call
+	chanRet := make(chan *RetInfo, 1)
+	select {
+	case c.s.ChanCall <- &CallInfo{id: id, f: f, args: args, chanRet: chanRet}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case ri = <-chanRet:
+		return ri, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) Call0Context(ctx context.Context, id interface{}, args ...interface{}) error {
+	f, err := c.f(id, 0)
+	if err != nil {
+		return err
+	}
+
+	ri, err := c.callContext(ctx, id, f, args)
+	if err != nil {
+		return err
+	}
+	return ri.err
+}
+
+func (c *Client) Call1Context(ctx context.Context, id interface{}, args ...interface{}) (interface{}, error) {
+	f, err := c.f(id, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	ri, err := c.callContext(ctx, id, f, args)
+	if err != nil {
+		return nil, err
+	}
+	return ri.ret, ri.err
+}
+
+func (c *Client) CallNContext(ctx context.Context, id interface{}, args ...interface{}) ([]interface{}, error) {
+	f, err := c.f(id, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	ri, err := c.callContext(ctx, id, f, args)
+	if err != nil {
+		return nil, err
+	}
+	return assert(ri.ret), ri.err
+}
+
 // 思路与同步调用相同，只是block设置为false，chanRet为chanAsynRet
 func (c *Client) asynCall(id interface{}, args []interface{}, cb interface{}, n int) {
+	chanRet := c.asynRet(cb)
+
 	f, err := c.f(id, n)
 	if err != nil {
-		c.ChanAsynRet <- &RetInfo{err: err, cb: cb}
+		chanRet <- &RetInfo{err: err, cb: cb}
 		return
 	}
 
 	err = c.call(&CallInfo{
+		id:      id,
 		f:       f,
 		args:    args,
-		chanRet: c.ChanAsynRet,
+		chanRet: chanRet,
 		cb:      cb,
 	}, false)
 	if err != nil {
-		c.ChanAsynRet <- &RetInfo{err: err, cb: cb}
+		chanRet <- &RetInfo{err: err, cb: cb}
 		return
 	}
 }
 
+// with AsynCallTimeout set, every call gets its own return channel so that
+// exactly one of the return and the timeout reaches ChanAsynRet, a late
+// return is dropped
+func (c *Client) asynRet(cb interface{}) chan *RetInfo {
+	if c.AsynCallTimeout <= 0 {
+		return c.ChanAsynRet
+	}
+
+	chanRet := make(chan *RetInfo, 1)
+	t := time.NewTimer(c.AsynCallTimeout)
+	go func() {
+		select {
+		case ri := <-chanRet:
+			t.Stop()
+			c.ChanAsynRet <- ri
+		case <-t.C:
+			c.ChanAsynRet <- &RetInfo{err: ErrTimeout, cb: cb}
+		}
+	}()
+	return chanRet
+}
+
 func (c *Client) AsynCall(id interface{}, _args ...interface{}) {
 	if len(_args) < 1 {
 		panic("callback function not found")
@@ -342,29 +495,49 @@ func (c *Client) AsynCall(id interface{}, _args ...interface{}) {
 
 	args := _args[:len(_args)-1]
 	cb := _args[len(_args)-1]
+	n := cbType(cb)
 
-	var n int
+	// too many calls
+	// 如果异步调用计数超过异步调用的通道（ChanAsynRet）容量，则直接执行回调函数抛出异常
+	if c.pendingAsynCall >= cap(c.ChanAsynRet) {
+		execCb(&RetInfo{err: errors.New("too many calls"), cb: cb})
+		return
+	}
+	// 异步调用
+	c.asynCall(id, args, cb, n)
+	// 异步调用计数+1
+	c.pendingAsynCall++
+}
+
+func cbType(cb interface{}) int {
 	switch cb.(type) {
 	case func(error):
-		n = 0
+		return 0
 	case func(interface{}, error):
-		n = 1
+		return 1
 	case func([]interface{}, error):
-		n = 2
+		return 2
 	default:
 		panic("definition of callback function is invalid")
 	}
+}
+
+// f runs in the current goroutine and must arrange for done to be called
+// exactly once, from any goroutine. The result is delivered to cb through
+// ChanAsynRet like a normal AsynCall
+func (c *Client) AsynCallFunc(f func(done func(ret interface{}, err error)), cb interface{}) {
+	cbType(cb)
 
-	// too many calls
-	// 如果异步调用计数超过异步调用的通道（ChanAsynRet）容量，则直接执行回调函数抛出异常
 	if c.pendingAsynCall >= cap(c.ChanAsynRet) {
 		execCb(&RetInfo{err: errors.New("too many calls"), cb: cb})
 		return
 	}
-	// 异步调用
-	c.asynCall(id, args, cb, n)
-	// 异步调用计数+1
+
 	c.pendingAsynCall++
+	chanRet := c.asynRet(cb)
+	f(func(ret interface{}, err error) {
+		chanRet <- &RetInfo{ret: ret, err: err, cb: cb}
+	})
 }
 
 // 通过RetInfo中获得cb函数，通过不同类型，进行cb调用。
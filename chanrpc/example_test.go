@@ -1,9 +1,14 @@
 package chanrpc_test
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/metrics"
+	"strings"
 	"sync"
+	"time"
 )
 
 func Example() {
@@ -125,3 +130,127 @@ func Example() {
 	// 1 2 3
 	// 3
 }
+
+func ExampleRegisterTyped() {
+	type AddReq struct {
+		N1, N2 int
+	}
+
+	s := chanrpc.NewServer(10)
+	chanrpc.RegisterTyped(s, "add", func(req *AddReq) (int, error) {
+		return req.N1 + req.N2, nil
+	})
+	chanrpc.RegisterTyped(s, "double", func(n int) (int, error) {
+		return 2 * n, nil
+	})
+
+	go func() {
+		for {
+			s.Exec(<-s.ChanCall)
+		}
+	}()
+
+	c := s.Open(10)
+
+	// sync
+	n, err := chanrpc.CallTyped[*AddReq, int](c, "add", &AddReq{1, 2})
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Println(n)
+	}
+
+	_, err = c.Call1("add", "1 + 2")
+	fmt.Println(err)
+	// nil is only accepted for the types which can be nil
+	_, err = c.Call1("double", nil)
+	fmt.Println(err)
+
+	// asyn
+	chanrpc.AsynCallTyped(c, "add", &AddReq{3, 4}, func(n int, err error) {
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println(n)
+		}
+	})
+	c.Cb(<-c.ChanAsynRet)
+
+	// Output:
+	// 3
+	// function id add: argument type mismatch: string (want *chanrpc_test.AddReq)
+	// function id double: argument type mismatch: <nil> (want int)
+	// 7
+}
+
+func ExampleClient_Call1Context() {
+	s := chanrpc.NewServer(10)
+	s.Register("f1", func(args []interface{}) interface{} {
+		return 1
+	})
+
+	// nobody executes the calls
+	c := s.Open(10)
+
+	// sync
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := c.Call1Context(ctx, "f1")
+	fmt.Println(err)
+
+	// asyn
+	c.AsynCallTimeout = 10 * time.Millisecond
+	c.AsynCall("f1", func(ret interface{}, err error) {
+		fmt.Println(err)
+	})
+	c.Close()
+	fmt.Println(c.Idle())
+
+	// Output:
+	// context deadline exceeded
+	// chanrpc call timeout
+	// true
+}
+
+func ExampleServer_Stats() {
+	s := chanrpc.NewServer(10)
+	s.EnableStats(0)
+	s.Register("f0", func(args []interface{}) {
+		if len(args) > 0 {
+			panic(args[0])
+		}
+	})
+
+	s.Go("f0")
+	s.Go("f0", "oops")
+	s.Go("f0")
+	for i := 0; i < 3; i++ {
+		s.Exec(<-s.ChanCall)
+	}
+
+	fs := s.Stats().Funcs["f0"]
+	fmt.Println(fs.Calls, fs.Errors, fs.Panics)
+
+	// Output:
+	// 3 0 1
+}
+
+func ExampleServer_ExportQueueLen() {
+	s := chanrpc.NewServer(10)
+	s.Register("f0", func(args []interface{}) {})
+	s.ExportQueueLen("example")
+
+	s.Go("f0")
+	s.Go("f0")
+
+	var buf bytes.Buffer
+	metrics.Write(&buf)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "leaf_chanrpc_queue_length") {
+			fmt.Println(line)
+		}
+	}
+
+	// Output:
+	// leaf_chanrpc_queue_length{server="example"} 2
+}
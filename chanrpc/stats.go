@@ -0,0 +1,161 @@
+package chanrpc
+
+import (
+	"fmt"
+	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/metrics"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upper bounds of the latency histogram, the last bucket of
+// FuncStats.Latency counts the calls slower than all of them
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+type FuncStats struct {
+	Calls     uint64
+	Errors    uint64
+	Panics    uint64
+	TotalTime time.Duration
+	MaxTime   time.Duration
+	Latency   []uint64
+}
+
+type Stats struct {
+	Funcs map[interface{}]*FuncStats
+	// current length of ChanCall, max and avg are sampled at every call,
+	// see ExportQueueLen for the length over time
+	QueueLen    int
+	QueueLenMax int
+	QueueLenAvg float64
+}
+
+type serverStats struct {
+	sync.Mutex
+	slowCall     time.Duration
+	funcs        map[interface{}]*FuncStats
+	queueLenMax  int
+	queueLenSum  uint64
+	queueSamples uint64
+}
+
+// calls slower than slowCall are logged, 0 means no logging
+// you must call the function before calling Open and Go
+func (s *Server) EnableStats(slowCall time.Duration) {
+	s.stats = new(serverStats)
+	s.stats.slowCall = slowCall
+	s.stats.funcs = make(map[interface{}]*FuncStats)
+}
+
+// returns nil if stats are not enabled
+// goroutine safe
+func (s *Server) Stats() *Stats {
+	if s.stats == nil {
+		return nil
+	}
+	stats := s.stats.snapshot()
+	stats.QueueLen = len(s.ChanCall)
+	return stats
+}
+
+// exports the current length of ChanCall as the gauge
+// leaf_chanrpc_queue_length{server="name"}, sampled at every scrape of the
+// metrics endpoint until Close, it does not need EnableStats
+//
+// name must not be empty
+func (s *Server) ExportQueueLen(name string) {
+	s.gauge = name
+	metrics.NewGaugeFunc("leaf_chanrpc_queue_length",
+		"Number of calls waiting in a chanrpc server.",
+		func() float64 { return float64(len(s.ChanCall)) },
+		"server", name)
+}
+
+// goroutine safe
+func (s *Server) ResetStats() {
+	if s.stats == nil {
+		return
+	}
+
+	s.stats.Lock()
+	defer s.stats.Unlock()
+	s.stats.funcs = make(map[interface{}]*FuncStats)
+	s.stats.queueLenMax = 0
+	s.stats.queueLenSum = 0
+	s.stats.queueSamples = 0
+}
+
+func (st *serverStats) sampleQueue(l int) {
+	st.Lock()
+	defer st.Unlock()
+
+	if l > st.queueLenMax {
+		st.queueLenMax = l
+	}
+	st.queueLenSum += uint64(l)
+	st.queueSamples++
+}
+
+func (st *serverStats) record(ci *CallInfo, d time.Duration, failed bool, panicked bool) {
+	st.Lock()
+	fs := st.funcs[ci.id]
+	if fs == nil {
+		fs = new(FuncStats)
+		fs.Latency = make([]uint64, len(LatencyBuckets)+1)
+		st.funcs[ci.id] = fs
+	}
+
+	fs.Calls++
+	if panicked {
+		fs.Panics++
+	} else if failed {
+		fs.Errors++
+	}
+	fs.TotalTime += d
+	if d > fs.MaxTime {
+		fs.MaxTime = d
+	}
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	fs.Latency[i]++
+	st.Unlock()
+
+	if st.slowCall > 0 && d >= st.slowCall {
+		log.Release("slow call: function id %v (%v) took %v", ci.id, argTypes(ci.args), d)
+	}
+}
+
+func (st *serverStats) snapshot() *Stats {
+	st.Lock()
+	defer st.Unlock()
+
+	stats := new(Stats)
+	stats.Funcs = make(map[interface{}]*FuncStats, len(st.funcs))
+	for id, fs := range st.funcs {
+		c := *fs
+		c.Latency = append([]uint64(nil), fs.Latency...)
+		stats.Funcs[id] = &c
+	}
+	stats.QueueLenMax = st.queueLenMax
+	if st.queueSamples > 0 {
+		stats.QueueLenAvg = float64(st.queueLenSum) / float64(st.queueSamples)
+	}
+	return stats
+}
+
+func argTypes(args []interface{}) string {
+	types := make([]string, len(args))
+	for i, arg := range args {
+		types[i] = fmt.Sprintf("%T", arg)
+	}
+	return strings.Join(types, ", ")
+}
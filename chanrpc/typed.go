@@ -0,0 +1,63 @@
+package chanrpc
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// you must call the function before calling Open and Go
+// the function can also be called by Call1 and AsynCall with func(interface{}, error)
+func RegisterTyped[Req, Resp any](s *Server, id interface{}, f func(Req) (Resp, error)) {
+	s.register(id, func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("function id %v: argument count mismatch: %v", id, len(args))
+		}
+		req, ok := args[0].(Req)
+		if !ok && (args[0] != nil || !nilable[Req]()) {
+			var want Req
+			return nil, fmt.Errorf("function id %v: argument type mismatch: %T (want %T)", id, args[0], want)
+		}
+		return f(req)
+	})
+}
+
+// whether nil is a value of T
+func nilable[T any]() bool {
+	switch reflect.TypeOf((*T)(nil)).Elem().Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan, reflect.Interface, reflect.UnsafePointer:
+		return true
+	}
+	return false
+}
+
+func assertTyped[Resp any](id interface{}, ret interface{}) (Resp, error) {
+	var resp Resp
+	if ret == nil {
+		return resp, nil
+	}
+	resp, ok := ret.(Resp)
+	if !ok {
+		return resp, fmt.Errorf("function id %v: return type mismatch: %T (want %T)", id, ret, resp)
+	}
+	return resp, nil
+}
+
+func CallTyped[Req, Resp any](c *Client, id interface{}, req Req) (Resp, error) {
+	ret, err := c.Call1(id, req)
+	if err != nil {
+		var resp Resp
+		return resp, err
+	}
+	return assertTyped[Resp](id, ret)
+}
+
+func AsynCallTyped[Req, Resp any](c *Client, id interface{}, req Req, cb func(Resp, error)) {
+	c.AsynCall(id, req, func(ret interface{}, err error) {
+		if err != nil {
+			var resp Resp
+			cb(resp, err)
+			return
+		}
+		cb(assertTyped[Resp](id, ret))
+	})
+}
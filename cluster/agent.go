@@ -0,0 +1,306 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/network"
+	"sync"
+)
+
+// values carried in args and return values are encoded with encoding/gob,
+// custom types must be registered by gob.Register on both nodes
+type message struct {
+	Hello *NodeInfo
+	Call  *callMsg
+	Ret   *retMsg
+}
+
+type callMsg struct {
+	// 0 means no return is expected
+	Seq    uint32
+	FuncID interface{}
+	// 0: Call0, 1: Call1, 2: CallN
+	N    int
+	Args []interface{}
+}
+
+type retMsg struct {
+	Seq uint32
+	Ret interface{}
+	Err string
+}
+
+func init() {
+	gob.Register([]interface{}{})
+}
+
+func marshal(msg *message) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func unmarshal(data []byte) (*message, error) {
+	msg := new(message)
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+type Agent struct {
+	conn         *network.TCPConn
+	self         *NodeInfo
+	dialed       bool
+	info         *NodeInfo
+	mutexPending sync.Mutex
+	seq          uint32
+	pending      map[uint32]func(interface{}, error)
+	// the calls of the peer, executed in order by one goroutine
+	calls chan *callMsg
+	// the kept agent of the node if this one is a standby
+	kept   *Agent
+	closed chan struct{}
+}
+
+// dialed is true for the connections of the clients
+func newAgent(conn *network.TCPConn, self *NodeInfo, dialed bool) *Agent {
+	a := new(Agent)
+	a.conn = conn
+	a.self = self
+	a.dialed = dialed
+	a.pending = make(map[uint32]func(interface{}, error))
+	a.calls = make(chan *callMsg, conf.PendingWriteNum)
+	a.closed = make(chan struct{})
+
+	err := a.writeMsg(&message{Hello: self})
+	if err != nil {
+		log.Error("write hello message error: %v", err)
+	}
+	return a
+}
+
+func (a *Agent) Run() {
+	done := make(chan struct{})
+	go func() {
+		for ci := range a.calls {
+			a.exec(ci)
+		}
+		close(done)
+	}()
+	defer func() {
+		close(a.calls)
+		<-done
+	}()
+
+	for {
+		data, err := a.conn.ReadMsg()
+		if err != nil {
+			log.Debug("read message: %v", err)
+			break
+		}
+
+		msg, err := unmarshal(data)
+		if err != nil {
+			log.Error("unmarshal message error: %v", err)
+			break
+		}
+
+		err = a.handle(msg)
+		if err != nil {
+			log.Error("handle message error: %v", err)
+			break
+		}
+		if a.kept != nil {
+			a.standby()
+			break
+		}
+	}
+}
+
+// the duplicate connection of two nodes dialing each other is kept idle
+// until the peer closes it or the kept one is closed, then the dialing node
+// closes it and its client reconnects. Closing it at once would make the
+// client reconnect every ConnectInterval
+func (a *Agent) standby() {
+	log.Debug("node %v already connected, connection from %v kept as a standby", a.info.Name, a.info.RemoteAddr)
+
+	readDone := make(chan struct{})
+	go func() {
+		for {
+			if _, err := a.conn.ReadMsg(); err != nil {
+				close(readDone)
+				return
+			}
+		}
+	}()
+
+	if a.dialed {
+		select {
+		case <-readDone:
+			return
+		case <-a.kept.closed:
+			a.conn.Close()
+		}
+	}
+	<-readDone
+}
+
+func (a *Agent) OnClose() {
+	if a.info != nil && removeAgent(a) {
+		log.Release("node %v disconnected", a.info.Name)
+	}
+	close(a.closed)
+
+	a.mutexPending.Lock()
+	pending := a.pending
+	a.pending = nil
+	a.mutexPending.Unlock()
+
+	for _, done := range pending {
+		done(nil, errors.New("connection closed"))
+	}
+}
+
+func (a *Agent) handle(msg *message) error {
+	if msg.Hello != nil {
+		if a.info != nil {
+			return errors.New("duplicate hello message")
+		}
+		if msg.Hello.Name == "" {
+			return errors.New("invalid node name")
+		}
+		a.info = msg.Hello
+		a.info.RemoteAddr = a.conn.RemoteAddr().String()
+		a.kept = addAgent(a)
+		if a.kept != nil {
+			return nil
+		}
+		log.Release("node %v (type %v, version %v) connected from %v",
+			a.info.Name, a.info.Type, a.info.Version, a.info.RemoteAddr)
+		return nil
+	}
+	if a.info == nil {
+		return errors.New("hello message required")
+	}
+
+	// reading blocks while the calls queue is full
+	if msg.Call != nil {
+		a.calls <- msg.Call
+	}
+	if msg.Ret != nil {
+		done := a.popPending(msg.Ret.Seq)
+		if done == nil {
+			return fmt.Errorf("unexpected return, seq %v", msg.Ret.Seq)
+		}
+
+		var err error
+		if msg.Ret.Err != "" {
+			err = errors.New(msg.Ret.Err)
+		}
+		done(msg.Ret.Ret, err)
+	}
+	return nil
+}
+
+func (a *Agent) exec(ci *callMsg) {
+	server := routers[ci.FuncID]
+	if server == nil {
+		a.ret(ci, nil, fmt.Errorf("function id %v: router not found", ci.FuncID))
+		return
+	}
+
+	if ci.Seq == 0 {
+		server.Go(ci.FuncID, ci.Args...)
+		return
+	}
+
+	var ret interface{}
+	var err error
+	switch ci.N {
+	case 0:
+		err = server.Call0(ci.FuncID, ci.Args...)
+	case 1:
+		ret, err = server.Call1(ci.FuncID, ci.Args...)
+	case 2:
+		ret, err = server.CallN(ci.FuncID, ci.Args...)
+	default:
+		err = fmt.Errorf("function id %v: invalid call type %v", ci.FuncID, ci.N)
+	}
+	a.ret(ci, ret, err)
+}
+
+func (a *Agent) ret(ci *callMsg, ret interface{}, err error) {
+	if ci.Seq == 0 {
+		if err != nil {
+			log.Error("%v", err)
+		}
+		return
+	}
+
+	ri := &retMsg{Seq: ci.Seq, Ret: ret}
+	if err != nil {
+		ri.Ret = nil
+		ri.Err = err.Error()
+	}
+	err = a.writeMsg(&message{Ret: ri})
+	if err != nil {
+		a.writeMsg(&message{Ret: &retMsg{Seq: ci.Seq, Err: err.Error()}})
+	}
+}
+
+// done is called exactly once, in the goroutine which receives the return,
+// unless the returned seq is popped first
+func (a *Agent) call(id interface{}, args []interface{}, n int, done func(interface{}, error)) uint32 {
+	a.mutexPending.Lock()
+	if a.pending == nil {
+		a.mutexPending.Unlock()
+		done(nil, errors.New("connection closed"))
+		return 0
+	}
+	a.seq++
+	if a.seq == 0 {
+		a.seq++
+	}
+	seq := a.seq
+	a.pending[seq] = done
+	a.mutexPending.Unlock()
+
+	err := a.writeMsg(&message{Call: &callMsg{Seq: seq, FuncID: id, N: n, Args: args}})
+	if err != nil {
+		if done := a.popPending(seq); done != nil {
+			done(nil, err)
+		}
+	}
+	return seq
+}
+
+func (a *Agent) goCall(id interface{}, args []interface{}) error {
+	return a.writeMsg(&message{Call: &callMsg{FuncID: id, Args: args}})
+}
+
+func (a *Agent) popPending(seq uint32) func(interface{}, error) {
+	a.mutexPending.Lock()
+	defer a.mutexPending.Unlock()
+
+	done := a.pending[seq]
+	delete(a.pending, seq)
+	return done
+}
+
+// goroutine safe
+func (a *Agent) writeMsg(msg *message) error {
+	data, err := marshal(msg)
+	if err != nil {
+		return err
+	}
+	return a.conn.WriteMsg(data)
+}
@@ -1,18 +1,45 @@
 package cluster
 
 import (
+	"github.com/name5566/leaf/chanrpc"
 	"github.com/name5566/leaf/conf"
 	"github.com/name5566/leaf/network"
 	"math"
+	"sync"
 	"time"
 )
 
 var (
 	server  *network.TCPServer
 	clients []*network.TCPClient
+
+	mutexAgents sync.Mutex
+	agents      = make(map[string]*Agent)
+
+	nodeChanRPC *chanrpc.Server
 )
 
+type NodeInfo struct {
+	Name       string
+	Type       string
+	Version    string
+	RemoteAddr string
+}
+
+// "NewNode" and "CloseNode" are called with a *NodeInfo
+// when a peer joins or leaves the cluster
+// you must call the function before calling cluster.Init
+func SetNodeChanRPC(server *chanrpc.Server) {
+	nodeChanRPC = server
+}
+
 func Init() {
+	self := &NodeInfo{
+		Name:    conf.NodeName,
+		Type:    conf.NodeType,
+		Version: conf.NodeVersion,
+	}
+
 	if conf.ListenAddr != "" {
 		server = new(network.TCPServer)
 		server.Addr = conf.ListenAddr
@@ -20,7 +47,9 @@ func Init() {
 		server.PendingWriteNum = conf.PendingWriteNum
 		server.LenMsgLen = 4
 		server.MaxMsgLen = math.MaxUint32
-		server.NewAgent = newAgent
+		server.NewAgent = func(conn *network.TCPConn) network.Agent {
+			return newAgent(conn, self, false)
+		}
 
 		server.Start()
 	}
@@ -31,9 +60,12 @@ func Init() {
 		client.ConnNum = 1
 		client.ConnectInterval = 3 * time.Second
 		client.PendingWriteNum = conf.PendingWriteNum
+		client.AutoReconnect = true
 		client.LenMsgLen = 4
 		client.MaxMsgLen = math.MaxUint32
-		client.NewAgent = newAgent
+		client.NewAgent = func(conn *network.TCPConn) network.Agent {
+			return newAgent(conn, self, true)
+		}
 
 		client.Start()
 		clients = append(clients, client)
@@ -50,16 +82,76 @@ func Destroy() {
 	}
 }
 
-type Agent struct {
-	conn *network.TCPConn
+// one connection is kept per node, when two nodes dial each other both
+// keep the one dialed by the node with the smaller name. If a is not kept,
+// the kept agent is returned and a becomes a standby, see Agent.standby
+func addAgent(a *Agent) *Agent {
+	mutexAgents.Lock()
+	old := agents[a.info.Name]
+	if old != nil && a.dialed != (a.self.Name < a.info.Name) {
+		mutexAgents.Unlock()
+		return old
+	}
+	agents[a.info.Name] = a
+	mutexAgents.Unlock()
+
+	// the replaced connection does not fire "CloseNode"
+	if old != nil {
+		old.conn.Close()
+		return nil
+	}
+	if nodeChanRPC != nil {
+		info := *a.info
+		nodeChanRPC.Go("NewNode", &info)
+	}
+	return nil
+}
+
+// false if a is not the connection of its node
+func removeAgent(a *Agent) bool {
+	mutexAgents.Lock()
+	ok := agents[a.info.Name] == a
+	if ok {
+		delete(agents, a.info.Name)
+	}
+	mutexAgents.Unlock()
+
+	if ok && nodeChanRPC != nil {
+		info := *a.info
+		nodeChanRPC.Go("CloseNode", &info)
+	}
+	return ok
+}
+
+func getAgent(nodeName string) *Agent {
+	mutexAgents.Lock()
+	defer mutexAgents.Unlock()
+
+	return agents[nodeName]
 }
 
-func newAgent(conn *network.TCPConn) network.Agent {
-	a := new(Agent)
-	a.conn = conn
-	return a
+// goroutine safe
+func Nodes() []*NodeInfo {
+	mutexAgents.Lock()
+	defer mutexAgents.Unlock()
+
+	nodes := make([]*NodeInfo, 0, len(agents))
+	for _, a := range agents {
+		info := *a.info
+		nodes = append(nodes, &info)
+	}
+	return nodes
 }
 
-func (a *Agent) Run() {}
+// goroutine safe
+func Node(name string) *NodeInfo {
+	mutexAgents.Lock()
+	defer mutexAgents.Unlock()
 
-func (a *Agent) OnClose() {}
+	a := agents[name]
+	if a == nil {
+		return nil
+	}
+	info := *a.info
+	return &info
+}
@@ -0,0 +1,192 @@
+package cluster
+
+import (
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/network"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// two nodes in one process, "a" listens and "b" dials
+func startNodes(t *testing.T, addr string) func() {
+	server := new(network.TCPServer)
+	server.Addr = addr
+	server.LenMsgLen = 4
+	server.NewAgent = func(conn *network.TCPConn) network.Agent {
+		return newAgent(conn, &NodeInfo{Name: "a"}, false)
+	}
+	server.Start()
+
+	client := new(network.TCPClient)
+	client.Addr = addr
+	client.LenMsgLen = 4
+	client.NewAgent = func(conn *network.TCPConn) network.Agent {
+		return newAgent(conn, &NodeInfo{Name: "b"}, true)
+	}
+	client.Start()
+
+	for Node("a") == nil || Node("b") == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return func() {
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestRPC(t *testing.T) {
+	s := chanrpc.NewServer(10)
+	var seqs []int
+	s.Register("seq", func(args []interface{}) {
+		seqs = append(seqs, args[0].(int))
+	})
+	s.Register("add", func(args []interface{}) interface{} {
+		return args[0].(int) + args[1].(int)
+	})
+	s.Register("slow", func(args []interface{}) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	for _, id := range []string{"seq", "add", "slow"} {
+		routers[id] = s
+	}
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+
+	stop := startNodes(t, "127.0.0.1:37001")
+	defer stop()
+
+	// the calls of a peer are executed in order
+	for i := 0; i < 100; i++ {
+		Go("a", "seq", i)
+	}
+	ret, err := Call1("a", "add", 1, 2)
+	if err != nil || ret != 3 {
+		t.Fatalf("Call1: %v, %v", ret, err)
+	}
+	if len(seqs) != 100 {
+		t.Fatalf("%v Go calls executed", len(seqs))
+	}
+	for i, n := range seqs {
+		if n != i {
+			t.Fatalf("Go call %v executed at %v", n, i)
+		}
+	}
+
+	timeout := conf.CallTimeout
+	conf.CallTimeout = 50 * time.Millisecond
+	defer func() { conf.CallTimeout = timeout }()
+	err = Call0("a", "slow")
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("Call0: %v", err)
+	}
+
+	_, err = Call1("c", "add", 1, 2)
+	if err == nil {
+		t.Fatal("call to an unknown node succeeded")
+	}
+}
+
+// a and b dial each other, one connection is kept, the other is a standby
+// until the kept one is closed
+func TestDuplicate(t *testing.T) {
+	events := chanrpc.NewServer(10)
+	var news, closes int
+	events.Register("NewNode", func(args []interface{}) { news++ })
+	events.Register("CloseNode", func(args []interface{}) { closes++ })
+	SetNodeChanRPC(events)
+	defer SetNodeChanRPC(nil)
+
+	var mutexConns sync.Mutex
+	conns := 0
+	newConn := func(conn *network.TCPConn, self *NodeInfo, dialed bool) network.Agent {
+		mutexConns.Lock()
+		conns++
+		mutexConns.Unlock()
+		return newAgent(conn, self, dialed)
+	}
+
+	var servers []*network.TCPServer
+	var clients []*network.TCPClient
+	for _, n := range []struct{ self, addr, peer string }{
+		{"a", "127.0.0.1:37002", "127.0.0.1:37003"},
+		{"b", "127.0.0.1:37003", "127.0.0.1:37002"},
+	} {
+		self := &NodeInfo{Name: n.self}
+		server := new(network.TCPServer)
+		server.Addr = n.addr
+		server.LenMsgLen = 4
+		server.NewAgent = func(conn *network.TCPConn) network.Agent {
+			return newConn(conn, self, false)
+		}
+		server.Start()
+		servers = append(servers, server)
+
+		client := new(network.TCPClient)
+		client.Addr = n.peer
+		client.LenMsgLen = 4
+		client.ConnectInterval = 10 * time.Millisecond
+		client.AutoReconnect = true
+		client.NewAgent = func(conn *network.TCPConn) network.Agent {
+			return newConn(conn, self, true)
+		}
+		client.Start()
+		clients = append(clients, client)
+	}
+
+	wait := func(d time.Duration) {
+		timeout := time.After(d)
+		for {
+			select {
+			case ci := <-events.ChanCall:
+				events.Exec(ci)
+			case <-timeout:
+				return
+			}
+		}
+	}
+	kept := func() {
+		a := getAgent("a")
+		b := getAgent("b")
+		if a == nil || b == nil || a.conn.LocalAddr().String() != b.conn.RemoteAddr().String() {
+			t.Fatal("the nodes kept different connections")
+		}
+	}
+
+	// the standby connection does not reconnect, a connection replaced
+	// while both nodes say hello is reconnected once
+	wait(200 * time.Millisecond)
+	mutexConns.Lock()
+	n := conns
+	mutexConns.Unlock()
+	wait(200 * time.Millisecond)
+	if news != 2 || closes != 0 {
+		t.Fatalf("%v NewNode, %v CloseNode", news, closes)
+	}
+	mutexConns.Lock()
+	if conns != n {
+		t.Fatalf("%v connections, then %v", n, conns)
+	}
+	mutexConns.Unlock()
+	kept()
+
+	// the nodes connect again
+	getAgent("b").conn.Close()
+	wait(300 * time.Millisecond)
+	if news != 4 || closes != 2 {
+		t.Fatalf("%v NewNode, %v CloseNode", news, closes)
+	}
+	kept()
+
+	for _, client := range clients {
+		client.Close()
+	}
+	for _, server := range servers {
+		server.Close()
+	}
+}
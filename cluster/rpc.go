@@ -0,0 +1,125 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/log"
+	"time"
+)
+
+var routers = make(map[interface{}]*chanrpc.Server)
+
+// you must call the function before calling cluster.Init
+// goroutine not safe
+func SetRouter(id interface{}, server *chanrpc.Server) {
+	if _, ok := routers[id]; ok {
+		log.Fatal("function id %v: router already set", id)
+	}
+	routers[id] = server
+}
+
+// goroutine safe
+func Go(nodeName string, id interface{}, args ...interface{}) {
+	a := getAgent(nodeName)
+	if a == nil {
+		log.Debug("node %v not connected", nodeName)
+		return
+	}
+
+	err := a.goCall(id, args)
+	if err != nil {
+		log.Error("function id %v: %v", id, err)
+	}
+}
+
+type retInfo struct {
+	ret interface{}
+	err error
+}
+
+func call(nodeName string, id interface{}, args []interface{}, n int) (interface{}, error) {
+	a := getAgent(nodeName)
+	if a == nil {
+		return nil, fmt.Errorf("node %v not connected", nodeName)
+	}
+
+	chanRet := make(chan *retInfo, 1)
+	seq := a.call(id, args, n, func(ret interface{}, err error) {
+		chanRet <- &retInfo{ret: ret, err: err}
+	})
+	if conf.CallTimeout <= 0 {
+		ri := <-chanRet
+		return ri.ret, ri.err
+	}
+
+	t := time.NewTimer(conf.CallTimeout)
+	defer t.Stop()
+	select {
+	case ri := <-chanRet:
+		return ri.ret, ri.err
+	case <-t.C:
+		// a late return is discarded
+		if a.popPending(seq) == nil {
+			ri := <-chanRet
+			return ri.ret, ri.err
+		}
+		return nil, fmt.Errorf("function id %v: call timeout", id)
+	}
+}
+
+// goroutine safe
+func Call0(nodeName string, id interface{}, args ...interface{}) error {
+	_, err := call(nodeName, id, args, 0)
+	return err
+}
+
+// goroutine safe
+func Call1(nodeName string, id interface{}, args ...interface{}) (interface{}, error) {
+	return call(nodeName, id, args, 1)
+}
+
+// goroutine safe
+func CallN(nodeName string, id interface{}, args ...interface{}) ([]interface{}, error) {
+	ret, err := call(nodeName, id, args, 2)
+	rets, _ := ret.([]interface{})
+	return rets, err
+}
+
+// implemented by *chanrpc.Client and *module.Skeleton
+type AsynCaller interface {
+	AsynCallFunc(f func(done func(interface{}, error)), cb interface{})
+}
+
+// the callback is delivered through the ChanAsynRet of the caller, bound
+// by its AsynCallTimeout
+// goroutine not safe (same as caller)
+func AsynCall(caller AsynCaller, nodeName string, id interface{}, _args ...interface{}) {
+	if len(_args) < 1 {
+		panic("callback function not found")
+	}
+
+	args := _args[:len(_args)-1]
+	cb := _args[len(_args)-1]
+
+	var n int
+	switch cb.(type) {
+	case func(error):
+		n = 0
+	case func(interface{}, error):
+		n = 1
+	case func([]interface{}, error):
+		n = 2
+	default:
+		panic("definition of callback function is invalid")
+	}
+
+	caller.AsynCallFunc(func(done func(interface{}, error)) {
+		a := getAgent(nodeName)
+		if a == nil {
+			done(nil, fmt.Errorf("node %v not connected", nodeName))
+			return
+		}
+		a.call(id, args, n, done)
+	}, cb)
+}
@@ -0,0 +1,467 @@
+// Command rfgen generates the record structs and the loader of a directory
+// of tab-separated tables.
+//
+// The first row of a table holds the column names, the second one the
+// annotations of the columns, space separated:
+//
+//	ID           Type         Name     Drops                   Notes
+//	int32 index  int multi    string   []int ref=Item.ID       -
+//
+//	TYPE           a Go type, int if only options are given
+//	index[=NAME]   unique index, NAME defaults to by<Field>, columns sharing
+//	               a NAME form a composite index
+//	multi[=NAME]   non-unique index
+//	optional       the column may be missing, or its cells empty
+//	default=VALUE  the value of a missing column or empty cell, takes the rest
+//	               of the annotation
+//	ref=TABLE.COL  every value must be found in the column COL of TABLE
+//	-              the column is ignored, e.g. designer notes, same as
+//	               no annotation
+//
+// Usage:
+//
+//	rfgen -in gamedata -pkg gamedata -out gamedata/records.go
+//
+// The generated Load function reads the tables by header, a table and its
+// struct can not drift apart without Load returning an error.
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var (
+	in  = flag.String("in", ".", "directory of the tables")
+	out = flag.String("out", "", "output file, stdout if empty")
+	pkg = flag.String("pkg", "gamedata", "package name of the output file")
+	ext = flag.String("ext", ".txt", "extension of the tables")
+)
+
+type column struct {
+	name     string
+	field    string
+	typ      string
+	indexes  []string
+	multis   []string
+	optional bool
+	defValue string
+	ref      string
+}
+
+type table struct {
+	file    string
+	name    string
+	columns []*column
+}
+
+type index struct {
+	name   string
+	unique bool
+	fields []*column
+}
+
+func main() {
+	flag.Parse()
+
+	tables, err := readTables(*in, *ext)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rfgen: %v\n", err)
+		os.Exit(1)
+	}
+
+	src, err := generate(*pkg, tables)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rfgen: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *out == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	err = os.WriteFile(*out, src, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rfgen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func readTables(dir string, ext string) ([]*table, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no %v files in %v", ext, dir)
+	}
+
+	var tables []*table
+	byName := make(map[string]*table)
+	for _, name := range names {
+		t, err := readTable(name)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		if other, ok := byName[t.name]; ok {
+			return nil, fmt.Errorf("%v: table %v already defined by %v", name, t.name, other.file)
+		}
+		byName[t.name] = t
+		tables = append(tables, t)
+	}
+
+	// refs name tables and columns as in the files
+	for _, t := range tables {
+		for _, c := range t.columns {
+			if c.ref == "" {
+				continue
+			}
+			target := strings.SplitN(c.ref, ".", 2)
+			if len(target) != 2 {
+				return nil, fmt.Errorf("%v: column %v: invalid ref %v", t.file, c.name, c.ref)
+			}
+			rt := byName[goName(target[0])]
+			if rt == nil {
+				return nil, fmt.Errorf("%v: column %v: table %v not found", t.file, c.name, target[0])
+			}
+			var rc *column
+			for _, c := range rt.columns {
+				if c.name == target[1] {
+					rc = c
+				}
+			}
+			if rc == nil {
+				return nil, fmt.Errorf("%v: column %v: column %v not found", t.file, c.name, c.ref)
+			}
+			c.ref = rt.name + "." + rc.field
+		}
+	}
+
+	return tables, nil
+}
+
+func readTable(name string) (*table, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comma = '\t'
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	var rows [][]string
+	for len(rows) < 2 {
+		row, err := r.Read()
+		if err == io.EOF {
+			return nil, fmt.Errorf("header and annotation rows required")
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	if len(rows[0]) > 0 {
+		rows[0][0] = strings.TrimPrefix(rows[0][0], "\ufeff")
+	}
+
+	base := filepath.Base(name)
+	t := &table{file: base, name: goName(strings.TrimSuffix(base, filepath.Ext(base)))}
+	if t.name == "" {
+		return nil, fmt.Errorf("invalid table name")
+	}
+
+	fields := make(map[string]string)
+	for i, name := range rows[0] {
+		name = strings.TrimSpace(name)
+		annotation := ""
+		if i < len(rows[1]) {
+			annotation = strings.TrimSpace(rows[1][i])
+		}
+		if annotation == "" || annotation == "-" || name == "" {
+			continue
+		}
+
+		c, err := parseColumn(name, annotation)
+		if err != nil {
+			return nil, fmt.Errorf("column %v: %v", name, err)
+		}
+		if other, ok := fields[c.field]; ok {
+			return nil, fmt.Errorf("column %v: field %v already used by column %v", name, c.field, other)
+		}
+		fields[c.field] = name
+		t.columns = append(t.columns, c)
+	}
+	if len(t.columns) == 0 {
+		return nil, fmt.Errorf("no columns")
+	}
+
+	return t, nil
+}
+
+func parseColumn(name string, annotation string) (*column, error) {
+	c := &column{name: name, field: goName(name)}
+	if c.field == "" {
+		return nil, fmt.Errorf("invalid column name")
+	}
+
+	for annotation != "" {
+		var word string
+		if strings.HasPrefix(annotation, "default=") {
+			word, annotation = annotation, ""
+		} else if i := strings.IndexFunc(annotation, unicode.IsSpace); i >= 0 {
+			word, annotation = annotation[:i], strings.TrimSpace(annotation[i:])
+		} else {
+			word, annotation = annotation, ""
+		}
+
+		kv := strings.SplitN(word, "=", 2)
+		switch kv[0] {
+		case "index", "multi":
+			indexName := "by" + c.field
+			if len(kv) == 2 && kv[1] != "" {
+				indexName = kv[1]
+			}
+			if kv[0] == "index" {
+				c.indexes = append(c.indexes, indexName)
+			} else {
+				c.multis = append(c.multis, indexName)
+			}
+		case "optional":
+			c.optional = true
+		case "default":
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("default value required")
+			}
+			c.defValue = kv[1]
+		case "ref":
+			if len(kv) != 2 || kv[1] == "" {
+				return nil, fmt.Errorf("ref target required")
+			}
+			c.ref = kv[1]
+		default:
+			if c.typ != "" {
+				return nil, fmt.Errorf("unknown annotation %v", word)
+			}
+			if _, err := parser.ParseExpr(word); err != nil {
+				return nil, fmt.Errorf("invalid type %v", word)
+			}
+			c.typ = word
+		}
+	}
+
+	if c.typ == "" {
+		c.typ = "int"
+	}
+	return c, nil
+}
+
+// "item_id" -> "ItemID", "drop-list" -> "DropList"
+func goName(s string) string {
+	parts := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var b strings.Builder
+	for _, p := range parts {
+		if strings.EqualFold(p, "id") {
+			b.WriteString("ID")
+			continue
+		}
+		r := []rune(p)
+		r[0] = unicode.ToUpper(r[0])
+		b.WriteString(string(r))
+	}
+
+	name := b.String()
+	if name != "" && unicode.IsDigit([]rune(name)[0]) {
+		name = "F" + name
+	}
+	return name
+}
+
+// "ID" -> "id", "ItemID" -> "itemID", "Type" -> "typ"
+func paramName(field string) string {
+	r := []rune(field)
+	n := 0
+	for n < len(r) && unicode.IsUpper(r[n]) {
+		n++
+	}
+	if n > 1 && n < len(r) {
+		n--
+	}
+	for i := 0; i < n; i++ {
+		r[i] = unicode.ToLower(r[i])
+	}
+
+	name := string(r)
+	if token.IsKeyword(name) {
+		name = name[:len(name)-1]
+	}
+	return name
+}
+
+func (c *column) tag() string {
+	var opts []string
+	if c.field != c.name {
+		opts = append(opts, "col="+c.name)
+	}
+	for _, name := range c.indexes {
+		opts = append(opts, "index="+name)
+	}
+	for _, name := range c.multis {
+		opts = append(opts, "multi="+name)
+	}
+	if c.optional && c.defValue == "" {
+		opts = append(opts, "optional")
+	}
+	if c.defValue != "" {
+		opts = append(opts, "default="+c.defValue)
+	}
+
+	var tags []string
+	if len(opts) > 0 {
+		tags = append(tags, fmt.Sprintf("rf:%q", strings.Join(opts, ",")))
+	}
+	if c.ref != "" {
+		tags = append(tags, fmt.Sprintf("ref:%q", c.ref))
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	return "`" + strings.Join(tags, " ") + "`"
+}
+
+func (t *table) indexes() []*index {
+	var indexes []*index
+	byName := make(map[string]*index)
+	for _, c := range t.columns {
+		for _, unique := range []bool{true, false} {
+			names := c.indexes
+			if !unique {
+				names = c.multis
+			}
+			for _, name := range names {
+				i := byName[name]
+				if i == nil {
+					i = &index{name: name, unique: unique}
+					byName[name] = i
+					indexes = append(indexes, i)
+				}
+				i.fields = append(i.fields, c)
+			}
+		}
+	}
+	return indexes
+}
+
+func generate(pkg string, tables []*table) ([]byte, error) {
+	var b bytes.Buffer
+	p := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, format, args...)
+		b.WriteString("\n")
+	}
+
+	p("// Code generated by rfgen. DO NOT EDIT.")
+	p("")
+	p("package %v", pkg)
+	p("")
+	p("import (")
+	p("%q", "github.com/name5566/leaf/recordfile")
+	p("%q", "path/filepath")
+	p(")")
+
+	for _, t := range tables {
+		p("")
+		p("// %v", t.file)
+		p("type %v struct {", t.name)
+		for _, c := range t.columns {
+			p("%v %v %v", c.field, c.typ, c.tag())
+		}
+		p("}")
+	}
+
+	p("")
+	p("var (")
+	for _, t := range tables {
+		p("%vFile = newRecordFile(%v{})", t.name, t.name)
+	}
+	p(")")
+	p("")
+	p("func newRecordFile(st interface{}) *recordfile.RecordFile {")
+	p("rf, err := recordfile.New(st)")
+	p("if err != nil {")
+	p("panic(err)")
+	p("}")
+	p("rf.ByHeader = true")
+	p("rf.HeaderRows = 2")
+	p("return rf")
+	p("}")
+
+	p("")
+	p("// reads every table from dir, no table is replaced unless all of them")
+	p("// and the references between them are valid")
+	p("func Load(dir string) error {")
+	p("l := recordfile.NewLoader()")
+	for _, t := range tables {
+		p("l.Add(%q, %vFile, filepath.Join(dir, %q))", t.name, t.name, t.file)
+	}
+	p("return l.Load()")
+	p("}")
+
+	// accessors
+	p("")
+	p("// the index names and the key types are generated from the tables, the")
+	p("// accessors have no recordfile errors to return")
+	for _, t := range tables {
+		p("")
+		p("func Num%v() int {", t.name)
+		p("return %vFile.NumRecord()", t.name)
+		p("}")
+		p("")
+		p("func %vAt(i int) *%v {", t.name, t.name)
+		p("r, _ := recordfile.RecordOf[%v](%vFile, i)", t.name, t.name)
+		p("return r")
+		p("}")
+
+		for _, i := range t.indexes() {
+			var params, args []string
+			for _, c := range i.fields {
+				params = append(params, paramName(c.field)+" "+c.typ)
+				args = append(args, paramName(c.field))
+			}
+			accessor := goName(i.name)
+
+			p("")
+			if i.unique {
+				p("func %v%v(%v) *%v {", t.name, accessor, strings.Join(params, ", "), t.name)
+				p("r, _ := recordfile.Get[%v](%vFile, %q, %v)", t.name, t.name, i.name, strings.Join(args, ", "))
+				p("return r")
+			} else {
+				p("func %vs%v(%v) []*%v {", t.name, accessor, strings.Join(params, ", "), t.name)
+				p("rs, _ := recordfile.GetAll[%v](%vFile, %q, %v)", t.name, t.name, i.name, strings.Join(args, ", "))
+				p("return rs")
+			}
+			p("}")
+		}
+	}
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format error: %v\n%s", err, b.Bytes())
+	}
+	return src, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden file")
+
+func TestGenerate(t *testing.T) {
+	tables, err := readTables("testdata", ".txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := generate("gamedata", tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := "testdata/records.golden"
+	if *update {
+		if err := os.WriteFile(golden, src, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(src) != string(want) {
+		t.Fatalf("generated source differs from %v, run go test -update to accept it:\n%s", golden, src)
+	}
+}
@@ -1,5 +1,9 @@
 package conf
 
+import (
+	"time"
+)
+
 var (
 	LenStackBuf = 4096
 
@@ -13,8 +17,20 @@ var (
 	ConsolePrompt string = "Leaf# "
 	ProfilePath   string
 
+	// metrics
+	MetricsAddr string
+
+	// shutdown
+	ShutdownDrainTime time.Duration
+	ShutdownTimeout   time.Duration
+
 	// cluster
+	NodeName        string
+	NodeType        string
+	NodeVersion     string
 	ListenAddr      string
 	ConnAddrs       []string
 	PendingWriteNum int
+	// of cluster.Call0, Call1 and CallN, 0 means no timeout
+	CallTimeout = 10 * time.Second
 )
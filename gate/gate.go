@@ -1,14 +1,28 @@
 package gate
 
 import (
+	"errors"
+	"fmt"
 	"github.com/name5566/leaf/chanrpc"
 	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/metrics"
 	"github.com/name5566/leaf/network"
 	"net"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// the reason of "CloseAgent" when the agent is closed by Close, Destroy or
+// the gate shutdown
+var ErrClosed = errors.New("agent closed")
+
+var (
+	tcpAgents = metrics.NewGauge("leaf_gate_agents", "Number of connected gate agents.", "conn", "tcp")
+	wsAgents  = metrics.NewGauge("leaf_gate_agents", "Number of connected gate agents.", "conn", "ws")
+)
+
 type Gate struct {
 	MaxConnNum      int
 	PendingWriteNum int
@@ -16,19 +30,76 @@ type Gate struct {
 	Processor       network.Processor
 	AgentChanRPC    *chanrpc.Server
 
-	// websocket
-	WSAddr      string
-	HTTPTimeout time.Duration
-	CertFile    string
-	KeyFile     string
+	// websocket, see network.WSServer for RealIPHeader
+	WSAddr       string
+	HTTPTimeout  time.Duration
+	CertFile     string
+	KeyFile      string
+	RealIPHeader string
 
 	// tcp
 	TCPAddr      string
 	LenMsgLen    int
 	LittleEndian bool
+
+	// shutdown
+	ShutdownMsg interface{}
+
+	// heartbeat, agents silent for ReadIdleTimeout are closed with
+	// network.ErrReadIdle, a heartbeat is written after WriteIdleTimeout
+	// without writing, a ping frame for websocket and an empty frame for
+	// tcp, see network.TCPServer. An empty frame is not a message, tcp
+	// clients must skip it and are expected to answer it, existing clients
+	// which read it as a protocol error must be updated before either
+	// timeout is set
+	ReadIdleTimeout  time.Duration
+	WriteIdleTimeout time.Duration
+
+	// compression of the messages of at least CompressThreshold bytes,
+	// permessage-deflate for websocket, negotiated with the clients for
+	// tcp, see network/compress.go. 0 disables compression. For tcp, the
+	// top bit of the len is the compress flag, MaxMsgLen is at most half
+	// the max len, 32767 with a LenMsgLen of 2
+	CompressThreshold uint32
+
+	// session resumption, see session.go
+	SessionTimeout   time.Duration
+	SessionBufferLen int
+
+	// rate limits, 0 means unlimited, see ratelimit.go. MsgRate and
+	// ByteRate are per connection and per second, the bursts default to one
+	// second of rate, RateLimitAction is LimitDrop, LimitDelay or
+	// LimitDisconnect. The connections of an IP over MaxConnPerIP or
+	// ConnRate are refused, the IP is the remote one, that of a reverse
+	// proxy for websocket unless RealIPHeader is set
+	MsgRate         float64
+	MsgBurst        int
+	ByteRate        float64
+	ByteBurst       int
+	RateLimitAction int
+	MaxConnPerIP    int
+	ConnRate        float64
+	ConnBurst       int
+
+	mutex     sync.Mutex
+	agents    map[Agent]struct{}
+	sessions  map[string]*session
+	ips       map[string]*ipState
+	groups    groups
+	ipsSwept  time.Time
+	wsServer  *network.WSServer
+	tcpServer *network.TCPServer
+	draining  bool
+	closed    bool
 }
 
 func (gate *Gate) Run(closeSig chan bool) {
+	if gate.SessionTimeout > 0 && gate.SessionBufferLen <= 0 {
+		gate.SessionBufferLen = 256
+		log.Release("invalid SessionBufferLen, reset to %v", gate.SessionBufferLen)
+	}
+	gate.initRateLimit()
+
 	var wsServer *network.WSServer
 	if gate.WSAddr != "" {
 		wsServer = new(network.WSServer)
@@ -39,12 +110,12 @@ func (gate *Gate) Run(closeSig chan bool) {
 		wsServer.HTTPTimeout = gate.HTTPTimeout
 		wsServer.CertFile = gate.CertFile
 		wsServer.KeyFile = gate.KeyFile
+		wsServer.RealIPHeader = gate.RealIPHeader
+		wsServer.ReadIdleTimeout = gate.ReadIdleTimeout
+		wsServer.WriteIdleTimeout = gate.WriteIdleTimeout
+		wsServer.CompressThreshold = gate.CompressThreshold
 		wsServer.NewAgent = func(conn *network.WSConn) network.Agent {
-			a := &agent{conn: conn, gate: gate}
-			if gate.AgentChanRPC != nil {
-				gate.AgentChanRPC.Go("NewAgent", a)
-			}
-			return a
+			return gate.newAgent(conn, wsAgents)
 		}
 	}
 
@@ -57,36 +128,143 @@ func (gate *Gate) Run(closeSig chan bool) {
 		tcpServer.LenMsgLen = gate.LenMsgLen
 		tcpServer.MaxMsgLen = gate.MaxMsgLen
 		tcpServer.LittleEndian = gate.LittleEndian
+		tcpServer.ReadIdleTimeout = gate.ReadIdleTimeout
+		tcpServer.WriteIdleTimeout = gate.WriteIdleTimeout
+		tcpServer.CompressThreshold = gate.CompressThreshold
 		tcpServer.NewAgent = func(conn *network.TCPConn) network.Agent {
-			a := &agent{conn: conn, gate: gate}
-			if gate.AgentChanRPC != nil {
-				gate.AgentChanRPC.Go("NewAgent", a)
-			}
-			return a
+			return gate.newAgent(conn, tcpAgents)
 		}
 	}
 
-	if wsServer != nil {
-		wsServer.Start()
-	}
-	if tcpServer != nil {
-		tcpServer.Start()
+	gate.mutex.Lock()
+	if !gate.draining {
+		if wsServer != nil {
+			wsServer.Start()
+			gate.wsServer = wsServer
+		}
+		if tcpServer != nil {
+			tcpServer.Start()
+			gate.tcpServer = tcpServer
+		}
 	}
+	gate.mutex.Unlock()
+
 	<-closeSig
+	gate.mutex.Lock()
+	gate.closed = true
+	for a := range gate.agents {
+		if a, ok := a.(*agent); ok {
+			atomic.StoreInt32(&a.closed, 1)
+		}
+	}
+	wsServer = gate.wsServer
+	tcpServer = gate.tcpServer
+	gate.mutex.Unlock()
 	if wsServer != nil {
 		wsServer.Close()
 	}
 	if tcpServer != nil {
 		tcpServer.Close()
 	}
+	gate.closeSessions()
+}
+
+func (gate *Gate) newAgent(conn network.Conn, numAgents *metrics.Gauge) network.Agent {
+	ip := ipOf(conn.RemoteAddr())
+	if !gate.connect(ip) {
+		log.Debug("refuse connection from %v: %v", ip, ErrRateLimited)
+		return refusedConn{}
+	}
+
+	numAgents.Inc()
+	if gate.SessionTimeout > 0 {
+		return &sessionConn{conn: conn, gate: gate, numAgents: numAgents, ip: ip, limiter: gate.newMsgLimiter()}
+	}
+
+	a := &agent{conn: conn, gate: gate, numAgents: numAgents, ip: ip, limiter: gate.newMsgLimiter()}
+	gate.addAgent(a)
+	if gate.AgentChanRPC != nil {
+		gate.AgentChanRPC.Go("NewAgent", a)
+	}
+	return a
 }
 
 func (gate *Gate) OnDestroy() {}
 
+// stops accepting connections and sends ShutdownMsg to every agent
+func (gate *Gate) OnDrain() {
+	gate.mutex.Lock()
+	gate.draining = true
+	wsServer := gate.wsServer
+	tcpServer := gate.tcpServer
+	agents := make([]Agent, 0, len(gate.agents))
+	for a := range gate.agents {
+		agents = append(agents, a)
+	}
+	gate.mutex.Unlock()
+
+	if wsServer != nil {
+		wsServer.CloseListener()
+	}
+	if tcpServer != nil {
+		tcpServer.CloseListener()
+	}
+
+	if gate.ShutdownMsg != nil {
+		for _, a := range agents {
+			a.WriteMsg(gate.ShutdownMsg)
+		}
+	}
+}
+
+func (gate *Gate) addAgent(a Agent) {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	if gate.agents == nil {
+		gate.agents = make(map[Agent]struct{})
+	}
+	gate.agents[a] = struct{}{}
+}
+
+func (gate *Gate) removeAgent(a Agent) {
+	gate.mutex.Lock()
+	delete(gate.agents, a)
+	gate.mutex.Unlock()
+
+	gate.leaveGroups(a)
+}
+
+// the connection must be closed on error
+func (gate *Gate) route(data []byte, a Agent) error {
+	if gate.Processor == nil {
+		return nil
+	}
+
+	msg, err := gate.Processor.Unmarshal(data)
+	if err != nil {
+		err = fmt.Errorf("unmarshal message error: %v", err)
+		log.Debug("%v", err)
+		return err
+	}
+	err = gate.Processor.Route(msg, a)
+	if err != nil {
+		err = fmt.Errorf("route message error: %v", err)
+		log.Debug("%v", err)
+		return err
+	}
+	return nil
+}
+
 type agent struct {
-	conn     network.Conn
-	gate     *Gate
-	userData interface{}
+	conn      network.Conn
+	gate      *Gate
+	userData  interface{}
+	numAgents *metrics.Gauge
+	ip        string
+	limiter   *msgLimiter
+	// set by Close and Destroy
+	closed int32
+	reason error
 }
 
 func (a *agent) Run() {
@@ -94,27 +272,39 @@ func (a *agent) Run() {
 		data, err := a.conn.ReadMsg()
 		if err != nil {
 			log.Debug("read message: %v", err)
+			a.reason = err
 			break
 		}
 
-		if a.gate.Processor != nil {
-			msg, err := a.gate.Processor.Unmarshal(data)
-			if err != nil {
-				log.Debug("unmarshal message error: %v", err)
-				break
-			}
-			err = a.gate.Processor.Route(msg, a)
-			if err != nil {
-				log.Debug("route message error: %v", err)
-				break
-			}
+		ok, err := a.limiter.check(data)
+		if err != nil {
+			a.reason = err
+			break
+		}
+		if !ok {
+			continue
+		}
+
+		err = a.gate.route(data, a)
+		if err != nil {
+			a.reason = err
+			break
 		}
 	}
+
+	if atomic.LoadInt32(&a.closed) == 1 {
+		a.reason = ErrClosed
+	}
 }
 
+// "CloseAgent" is called with the agent and the reason, an error
 func (a *agent) OnClose() {
+	a.numAgents.Dec()
+	a.gate.disconnect(a.ip)
+	a.gate.removeAgent(a)
+
 	if a.gate.AgentChanRPC != nil {
-		err := a.gate.AgentChanRPC.Call0("CloseAgent", a)
+		err := a.gate.AgentChanRPC.Call0("CloseAgent", a, a.reason)
 		if err != nil {
 			log.Error("chanrpc error: %v", err)
 		}
@@ -135,6 +325,22 @@ func (a *agent) WriteMsg(msg interface{}) {
 	}
 }
 
+func (a *agent) owner() *Gate {
+	return a.gate
+}
+
+func (a *agent) writeData(data [][]byte, pm *network.PreparedMsg) {
+	var err error
+	if w, ok := a.conn.(preparedWriter); ok && pm != nil {
+		err = w.WritePreparedMsg(pm)
+	} else {
+		err = a.conn.WriteMsg(data...)
+	}
+	if err != nil {
+		log.Error("write message error: %v", err)
+	}
+}
+
 func (a *agent) LocalAddr() net.Addr {
 	return a.conn.LocalAddr()
 }
@@ -144,10 +350,12 @@ func (a *agent) RemoteAddr() net.Addr {
 }
 
 func (a *agent) Close() {
+	atomic.StoreInt32(&a.closed, 1)
 	a.conn.Close()
 }
 
 func (a *agent) Destroy() {
+	atomic.StoreInt32(&a.closed, 1)
 	a.conn.Destroy()
 }
 
@@ -0,0 +1,240 @@
+package gate
+
+import (
+	"encoding/binary"
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/network"
+	"github.com/name5566/leaf/network/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Echo struct {
+	N int
+}
+
+type event struct {
+	id     string
+	agent  Agent
+	reason error
+}
+
+type routed struct {
+	msg   *Echo
+	agent Agent
+}
+
+type harness struct {
+	t      *testing.T
+	gate   *Gate
+	events chan event
+	msgs   chan routed
+	stop   func()
+}
+
+// runs gate with a json processor of Echo and an AgentChanRPC recording
+// the events, the tcp clients use a len of 2 bytes
+func startGate(t *testing.T, gate *Gate) *harness {
+	h := &harness{t: t, gate: gate, events: make(chan event, 100), msgs: make(chan routed, 100)}
+
+	p := json.NewProcessor()
+	p.Register(&Echo{})
+	p.SetHandler(&Echo{}, func(args []interface{}) {
+		h.msgs <- routed{args[0].(*Echo), args[1].(Agent)}
+	})
+	gate.Processor = p
+	gate.LenMsgLen = 2
+	if gate.MaxMsgLen == 0 {
+		gate.MaxMsgLen = 4096
+	}
+
+	server := chanrpc.NewServer(100)
+	for _, id := range []string{"NewAgent", "CloseAgent", "DetachAgent", "ReattachAgent"} {
+		id := id
+		server.Register(id, func(args []interface{}) {
+			e := event{id: id, agent: args[0].(Agent)}
+			if len(args) > 1 {
+				e.reason, _ = args[1].(error)
+			}
+			h.events <- e
+		})
+	}
+	gate.AgentChanRPC = server
+	serverDone := make(chan struct{})
+	go func() {
+		for ci := range server.ChanCall {
+			server.Exec(ci)
+		}
+		close(serverDone)
+	}()
+
+	closeSig := make(chan bool, 1)
+	done := make(chan struct{})
+	go func() {
+		gate.Run(closeSig)
+		close(done)
+	}()
+
+	var once sync.Once
+	h.stop = func() {
+		once.Do(func() {
+			closeSig <- true
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("gate not closed")
+			}
+			server.Close()
+			<-serverDone
+		})
+	}
+	return h
+}
+
+func (h *harness) expect(id string) event {
+	h.t.Helper()
+	select {
+	case e := <-h.events:
+		if e.id != id {
+			h.t.Fatalf("%v (%v), want %v", e.id, e.reason, id)
+		}
+		return e
+	case <-time.After(time.Second):
+		h.t.Fatalf("no %v", id)
+	}
+	return event{}
+}
+
+func (h *harness) expectNone(d time.Duration) {
+	h.t.Helper()
+	select {
+	case e := <-h.events:
+		h.t.Fatalf("unexpected %v (%v)", e.id, e.reason)
+	case <-time.After(d):
+	}
+}
+
+func (h *harness) expectMsg() routed {
+	h.t.Helper()
+	select {
+	case m := <-h.msgs:
+		return m
+	case <-time.After(time.Second):
+		h.t.Fatal("no message routed")
+	}
+	return routed{}
+}
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// retries until the gate listens
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return &client{t: t, conn: conn}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dial: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (c *client) write(args ...[]byte) {
+	c.t.Helper()
+	var msg []byte
+	for _, b := range args {
+		msg = append(msg, b...)
+	}
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+// the error if the connection is closed
+func (c *client) tryRead() ([]byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(c.conn, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (c *client) read() []byte {
+	c.t.Helper()
+	b, err := c.tryRead()
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return b
+}
+
+func (c *client) close() {
+	c.conn.Close()
+}
+
+func TestReadIdle(t *testing.T) {
+	h := startGate(t, &Gate{TCPAddr: "127.0.0.1:37111", ReadIdleTimeout: 50 * time.Millisecond})
+	defer h.stop()
+
+	c := dial(t, h.gate.TCPAddr)
+	defer c.close()
+	a := h.expect("NewAgent").agent
+
+	// the heartbeats keep the agent
+	for i := 0; i < 5; i++ {
+		c.write()
+		time.Sleep(20 * time.Millisecond)
+	}
+	h.expectNone(0)
+
+	if e := h.expect("CloseAgent"); e.agent != a || e.reason != network.ErrReadIdle {
+		t.Fatalf("CloseAgent %v, %v", e.agent, e.reason)
+	}
+	if _, err := c.tryRead(); err == nil {
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestWriteIdle(t *testing.T) {
+	h := startGate(t, &Gate{TCPAddr: "127.0.0.1:37112", WriteIdleTimeout: 50 * time.Millisecond})
+	defer h.stop()
+
+	c := dial(t, h.gate.TCPAddr)
+	defer c.close()
+	a := h.expect("NewAgent").agent
+
+	start := time.Now()
+	if b := c.read(); len(b) != 0 {
+		t.Fatalf("read %s, want a heartbeat", b)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Fatalf("heartbeat after %v", d)
+	}
+
+	a.WriteMsg(&Echo{1})
+	b := c.read()
+	for len(b) == 0 {
+		b = c.read()
+	}
+	if string(b) != `{"Echo":{"N":1}}` {
+		t.Fatalf("read %s", b)
+	}
+}
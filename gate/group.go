@@ -0,0 +1,171 @@
+package gate
+
+import (
+	"errors"
+	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/network"
+	"reflect"
+	"sync"
+)
+
+var (
+	ErrGroupExists   = errors.New("group already exists")
+	ErrGroupNotFound = errors.New("group not found")
+	ErrForeignAgent  = errors.New("not an agent of the gate")
+)
+
+// the agents of a gate, a broadcast marshals the message once and writes
+// the same bytes to every member, pm holds data for the connections which
+// can share their frame
+type dataWriter interface {
+	owner() *Gate
+	writeData(data [][]byte, pm *network.PreparedMsg)
+}
+
+// network.TCPConn and network.WSConn
+type preparedWriter interface {
+	WritePreparedMsg(pm *network.PreparedMsg) error
+}
+
+type groups struct {
+	mutex sync.Mutex
+	// name -> members
+	groups map[string]map[Agent]struct{}
+	// agent -> names
+	joined map[Agent]map[string]struct{}
+}
+
+// goroutine safe
+func (gate *Gate) CreateGroup(name string) error {
+	g := &gate.groups
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if _, ok := g.groups[name]; ok {
+		return ErrGroupExists
+	}
+	if g.groups == nil {
+		g.groups = make(map[string]map[Agent]struct{})
+		g.joined = make(map[Agent]map[string]struct{})
+	}
+	g.groups[name] = make(map[Agent]struct{})
+	return nil
+}
+
+// the members leave the group
+//
+// goroutine safe
+func (gate *Gate) DestroyGroup(name string) {
+	g := &gate.groups
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for a := range g.groups[name] {
+		g.leave(name, a)
+	}
+	delete(g.groups, name)
+}
+
+// the agent leaves its groups when it is closed, before "CloseAgent" is
+// called, ErrForeignAgent if a is not an agent of the gate and ErrClosed if
+// it is already closed
+//
+// goroutine safe
+func (gate *Gate) Join(name string, a Agent) error {
+	if w, ok := a.(dataWriter); !ok || w.owner() != gate {
+		return ErrForeignAgent
+	}
+
+	g := &gate.groups
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	members, ok := g.groups[name]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	// a closed agent must not join again
+	gate.mutex.Lock()
+	_, alive := gate.agents[a]
+	gate.mutex.Unlock()
+	if !alive {
+		return ErrClosed
+	}
+
+	members[a] = struct{}{}
+	if g.joined[a] == nil {
+		g.joined[a] = make(map[string]struct{})
+	}
+	g.joined[a][name] = struct{}{}
+	return nil
+}
+
+// goroutine safe
+func (gate *Gate) Leave(name string, a Agent) {
+	g := &gate.groups
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.leave(name, a)
+}
+
+// called with the mutex held
+func (g *groups) leave(name string, a Agent) {
+	delete(g.groups[name], a)
+	delete(g.joined[a], name)
+	if len(g.joined[a]) == 0 {
+		delete(g.joined, a)
+	}
+}
+
+func (gate *Gate) leaveGroups(a Agent) {
+	g := &gate.groups
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for name := range g.joined[a] {
+		delete(g.groups[name], a)
+	}
+	delete(g.joined, a)
+}
+
+// goroutine safe
+func (gate *Gate) GroupMembers(name string) ([]Agent, error) {
+	g := &gate.groups
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	members, ok := g.groups[name]
+	if !ok {
+		return nil, ErrGroupNotFound
+	}
+	agents := make([]Agent, 0, len(members))
+	for a := range members {
+		agents = append(agents, a)
+	}
+	return agents, nil
+}
+
+// the message is marshaled once and framed once for the agents without
+// session, a session adds its own frame header
+//
+// goroutine safe
+func (gate *Gate) Broadcast(name string, msg interface{}) error {
+	members, err := gate.GroupMembers(name)
+	if err != nil {
+		return err
+	}
+	if gate.Processor == nil || len(members) == 0 {
+		return nil
+	}
+
+	data, err := gate.Processor.Marshal(msg)
+	if err != nil {
+		log.Error("marshal message %v error: %v", reflect.TypeOf(msg), err)
+		return err
+	}
+	pm := network.NewPreparedMsg(data...)
+	for _, a := range members {
+		a.(dataWriter).writeData(data, pm)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package gate
+
+import (
+	"github.com/gorilla/websocket"
+	"testing"
+	"time"
+)
+
+func TestBroadcast(t *testing.T) {
+	h := startGate(t, &Gate{TCPAddr: "127.0.0.1:37131", WSAddr: "127.0.0.1:37132"})
+	defer h.stop()
+	if err := h.gate.CreateGroup("room"); err != nil {
+		t.Fatal(err)
+	}
+
+	var clients []*client
+	for i := 0; i < 2; i++ {
+		c := dial(t, h.gate.TCPAddr)
+		defer c.close()
+		clients = append(clients, c)
+		if err := h.gate.Join("room", h.expect("NewAgent").agent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+h.gate.WSAddr, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	if err := h.gate.Join("room", h.expect("NewAgent").agent); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.gate.Broadcast("room", &Echo{1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range clients {
+		if b := c.read(); string(b) != `{"Echo":{"N":1}}` {
+			t.Fatalf("tcp read %s", b)
+		}
+	}
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if _, b, err := ws.ReadMessage(); err != nil || string(b) != `{"Echo":{"N":1}}` {
+		t.Fatalf("ws read %s, %v", b, err)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	h := startGate(t, &Gate{TCPAddr: "127.0.0.1:37133"})
+	defer h.stop()
+	other := &Gate{}
+	other.CreateGroup("room")
+	h.gate.CreateGroup("room")
+
+	c := dial(t, h.gate.TCPAddr)
+	a := h.expect("NewAgent").agent
+	if err := h.gate.Join("none", a); err != ErrGroupNotFound {
+		t.Fatalf("Join an unknown group: %v", err)
+	}
+	if err := other.Join("room", a); err != ErrForeignAgent {
+		t.Fatalf("Join another gate: %v", err)
+	}
+	if err := h.gate.Join("room", a); err != nil {
+		t.Fatal(err)
+	}
+
+	// a closed agent leaves its groups
+	c.close()
+	h.expect("CloseAgent")
+	if members, _ := h.gate.GroupMembers("room"); len(members) != 0 {
+		t.Fatalf("%v members", len(members))
+	}
+	if err := h.gate.Join("room", a); err != ErrClosed {
+		t.Fatalf("Join a closed agent: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package gate
+
+import (
+	"errors"
+	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/metrics"
+	"math"
+	"net"
+	"time"
+)
+
+// what an agent exceeding MsgRate or ByteRate gets
+const (
+	// the message is discarded
+	LimitDrop = iota
+	// reading is paused until the tokens are available
+	LimitDelay
+	// the agent is closed with ErrRateLimited
+	LimitDisconnect
+)
+
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+var (
+	msgsLimited        = metrics.NewCounter("leaf_gate_rate_limited_total", "Number of rate limit violations.", "limit", "msgs")
+	bytesLimited       = metrics.NewCounter("leaf_gate_rate_limited_total", "Number of rate limit violations.", "limit", "bytes")
+	connsLimited       = metrics.NewCounter("leaf_gate_rate_limited_total", "Number of rate limit violations.", "limit", "conns")
+	connectRateLimited = metrics.NewCounter("leaf_gate_rate_limited_total", "Number of rate limit violations.", "limit", "connect_rate")
+)
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// nil if rate is not positive, that is unlimited
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// n is at most the burst, a message longer than the burst takes it all
+func (b *tokenBucket) has(n float64, now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= math.Min(n, b.burst)
+}
+
+func (b *tokenBucket) take(n float64) {
+	b.tokens -= math.Min(n, b.burst)
+}
+
+// takes n tokens, going into debt if short, and returns how long to wait
+// for the debt to be paid
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	b.refill(now)
+	b.take(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+func (gate *Gate) initRateLimit() {
+	if gate.MsgRate > 0 && gate.MsgBurst <= 0 {
+		gate.MsgBurst = int(math.Ceil(gate.MsgRate))
+		log.Release("invalid MsgBurst, reset to %v", gate.MsgBurst)
+	}
+	// a message of MaxMsgLen must fit
+	if gate.ByteRate > 0 && gate.ByteBurst <= 0 {
+		gate.ByteBurst = int(math.Max(math.Ceil(gate.ByteRate), float64(gate.MaxMsgLen)))
+		log.Release("invalid ByteBurst, reset to %v", gate.ByteBurst)
+	}
+	if gate.ConnRate > 0 && gate.ConnBurst <= 0 {
+		gate.ConnBurst = int(math.Ceil(gate.ConnRate))
+		log.Release("invalid ConnBurst, reset to %v", gate.ConnBurst)
+	}
+	if gate.RateLimitAction < LimitDrop || gate.RateLimitAction > LimitDisconnect {
+		log.Fatal("invalid RateLimitAction %v", gate.RateLimitAction)
+	}
+}
+
+// the message limits of a connection (goroutine not safe)
+type msgLimiter struct {
+	gate  *Gate
+	msgs  *tokenBucket
+	bytes *tokenBucket
+}
+
+func (gate *Gate) newMsgLimiter() *msgLimiter {
+	return &msgLimiter{
+		gate:  gate,
+		msgs:  newTokenBucket(gate.MsgRate, gate.MsgBurst),
+		bytes: newTokenBucket(gate.ByteRate, gate.ByteBurst),
+	}
+}
+
+// false if the message must be dropped, ErrRateLimited if the connection
+// must be closed
+func (l *msgLimiter) check(data []byte) (bool, error) {
+	if l.msgs == nil && l.bytes == nil {
+		return true, nil
+	}
+
+	now := time.Now()
+	if l.gate.RateLimitAction == LimitDelay {
+		var wait time.Duration
+		if l.msgs != nil {
+			if d := l.msgs.reserve(1, now); d > 0 {
+				msgsLimited.Inc()
+				wait = d
+			}
+		}
+		if l.bytes != nil {
+			if d := l.bytes.reserve(float64(len(data)), now); d > 0 {
+				bytesLimited.Inc()
+				if d > wait {
+					wait = d
+				}
+			}
+		}
+		time.Sleep(wait)
+		return true, nil
+	}
+
+	// the tokens of a dropped message are not taken
+	n := float64(len(data))
+	if l.msgs != nil && !l.msgs.has(1, now) {
+		msgsLimited.Inc()
+	} else if l.bytes != nil && !l.bytes.has(n, now) {
+		bytesLimited.Inc()
+	} else {
+		if l.msgs != nil {
+			l.msgs.take(1)
+		}
+		if l.bytes != nil {
+			l.bytes.take(n)
+		}
+		return true, nil
+	}
+
+	if l.gate.RateLimitAction == LimitDisconnect {
+		return false, ErrRateLimited
+	}
+	log.Debug("drop message: %v", ErrRateLimited)
+	return false, nil
+}
+
+type ipState struct {
+	conns   int
+	connect *tokenBucket
+}
+
+func ipOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// false if the connection from ip must be refused, the IP limits never
+// delay, the accepting goroutine would be blocked
+func (gate *Gate) connect(ip string) bool {
+	if gate.MaxConnPerIP <= 0 && gate.ConnRate <= 0 {
+		return true
+	}
+
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+
+	now := time.Now()
+	if gate.ips == nil {
+		gate.ips = make(map[string]*ipState)
+	}
+	gate.sweepIPs(now)
+
+	s := gate.ips[ip]
+	if s == nil {
+		s = &ipState{connect: newTokenBucket(gate.ConnRate, gate.ConnBurst)}
+		gate.ips[ip] = s
+	}
+	if gate.MaxConnPerIP > 0 && s.conns >= gate.MaxConnPerIP {
+		connsLimited.Inc()
+		return false
+	}
+	if s.connect != nil {
+		if !s.connect.has(1, now) {
+			connectRateLimited.Inc()
+			return false
+		}
+		s.connect.take(1)
+	}
+	s.conns++
+	return true
+}
+
+func (gate *Gate) disconnect(ip string) {
+	if gate.MaxConnPerIP <= 0 && gate.ConnRate <= 0 {
+		return
+	}
+
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	if s := gate.ips[ip]; s != nil {
+		s.conns--
+	}
+}
+
+// forgets the IPs without connections once their bucket is full again,
+// at most once a minute, called with the mutex held
+func (gate *Gate) sweepIPs(now time.Time) {
+	if now.Sub(gate.ipsSwept) < time.Minute {
+		return
+	}
+	gate.ipsSwept = now
+
+	for ip, s := range gate.ips {
+		if s.conns == 0 && (s.connect == nil || s.connect.full(now)) {
+			delete(gate.ips, ip)
+		}
+	}
+}
+
+// the connection refused by the IP limits
+type refusedConn struct{}
+
+func (refusedConn) Run()     {}
+func (refusedConn) OnClose() {}
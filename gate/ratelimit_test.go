@@ -0,0 +1,162 @@
+package gate
+
+import (
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	if newTokenBucket(0, 10) != nil {
+		t.Fatal("a bucket without rate")
+	}
+
+	b := newTokenBucket(10, 5)
+	now := b.last
+	if !b.has(5, now) {
+		t.Fatal("the bucket starts empty")
+	}
+	b.take(5)
+	if b.has(1, now) {
+		t.Fatal("token taken twice")
+	}
+	now = now.Add(100 * time.Millisecond)
+	if !b.has(1, now) || b.has(2, now) {
+		t.Fatalf("%v tokens after 100ms, want 1", b.tokens)
+	}
+
+	// refilled up to the burst, a message over it takes it all
+	now = now.Add(time.Hour)
+	if !b.full(now) || b.tokens != 5 {
+		t.Fatalf("%v tokens, want 5", b.tokens)
+	}
+	if !b.has(100, now) {
+		t.Fatal("message over the burst refused")
+	}
+	b.take(100)
+	if b.tokens != 0 {
+		t.Fatalf("%v tokens, want 0", b.tokens)
+	}
+
+	// the debt is paid at rate
+	if d := b.reserve(1, now); d != 100*time.Millisecond {
+		t.Fatalf("reserve: wait %v", d)
+	}
+	if d := b.reserve(1, now.Add(200*time.Millisecond)); d != 0 {
+		t.Fatalf("reserve: wait %v", d)
+	}
+}
+
+// true if the gate kept the connection, a refused one is closed without
+// an agent
+func (h *harness) accepted(c *client) bool {
+	h.t.Helper()
+	select {
+	case e := <-h.events:
+		if e.id != "NewAgent" {
+			h.t.Fatalf("%v, want NewAgent", e.id)
+		}
+		return true
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := c.tryRead(); err == nil {
+		h.t.Fatal("refused connection not closed")
+	}
+	return false
+}
+
+func TestMaxConnPerIP(t *testing.T) {
+	h := startGate(t, &Gate{TCPAddr: "127.0.0.1:37121", MaxConnPerIP: 2})
+	defer h.stop()
+
+	var clients []*client
+	for i := 0; i < 3; i++ {
+		c := dial(t, h.gate.TCPAddr)
+		defer c.close()
+		if h.accepted(c) != (i < 2) {
+			t.Fatalf("connection %v accepted %v", i, i >= 2)
+		}
+		clients = append(clients, c)
+	}
+
+	// a closed connection makes room
+	clients[0].close()
+	h.expect("CloseAgent")
+	c := dial(t, h.gate.TCPAddr)
+	defer c.close()
+	if !h.accepted(c) {
+		t.Fatal("connection refused after a close")
+	}
+}
+
+func TestConnRate(t *testing.T) {
+	h := startGate(t, &Gate{TCPAddr: "127.0.0.1:37122", ConnRate: 10, ConnBurst: 2})
+	defer h.stop()
+
+	for i := 0; i < 3; i++ {
+		c := dial(t, h.gate.TCPAddr)
+		defer c.close()
+		if h.accepted(c) != (i < 2) {
+			t.Fatalf("connection %v accepted %v", i, i >= 2)
+		}
+	}
+
+	// a token every 100ms
+	time.Sleep(150 * time.Millisecond)
+	c := dial(t, h.gate.TCPAddr)
+	defer c.close()
+	if !h.accepted(c) {
+		t.Fatal("connection refused after the refill")
+	}
+}
+
+// the limits of the clients of a reverse proxy use RealIPHeader
+func TestRealIP(t *testing.T) {
+	h := startGate(t, &Gate{WSAddr: "127.0.0.1:37123", RealIPHeader: "X-Forwarded-For", MaxConnPerIP: 1})
+	defer h.stop()
+
+	var conns []*websocket.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	// the connections are kept until the end
+	ws := func(forwardedFor string) (bool, net.Addr) {
+		header := http.Header{"X-Forwarded-For": {forwardedFor}}
+		var conn *websocket.Conn
+		var err error
+		for i := 0; i < 100; i++ {
+			conn, _, err = websocket.DefaultDialer.Dial("ws://"+h.gate.WSAddr, header)
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conns = append(conns, conn)
+
+		select {
+		case e := <-h.events:
+			return true, e.agent.RemoteAddr()
+		case <-time.After(100 * time.Millisecond):
+			return false, nil
+		}
+	}
+
+	// the last address is the one added by the proxy
+	ok, addr := ws("10.0.0.1, 192.0.2.1")
+	if !ok || addr.(*net.TCPAddr).IP.String() != "192.0.2.1" {
+		t.Fatalf("accepted %v, remote address %v", ok, addr)
+	}
+	if ok, _ := ws("10.0.0.1, 192.0.2.1"); ok {
+		t.Fatal("MaxConnPerIP not applied to the real IP")
+	}
+	if ok, _ := ws("192.0.2.2"); !ok {
+		t.Fatal("another real IP refused")
+	}
+}
@@ -0,0 +1,449 @@
+package gate
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/metrics"
+	"github.com/name5566/leaf/network"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// With Gate.SessionTimeout set, the messages of the Processor are wrapped
+// in frames starting with a frame type, integers use the byte order of
+// Gate.LittleEndian:
+//
+//	client -> gate  hello    0x01 | last acked seq (8) | token (0 or 16)
+//	gate -> client  welcome  0x02 | resumed (1) | token (16)
+//	gate -> client  data     0x03 | seq (8) | message
+//	client -> gate  data     0x03 | message
+//	client -> gate  ack      0x04 | seq (8)
+//
+// The first frame of a connection is a hello, without a token it starts a
+// new session. A session outlives its connection for SessionTimeout, the
+// last SessionBufferLen messages not acked by the client are kept and
+// written again when a hello presents the token of the session. If the
+// missed messages are no longer buffered, the old session is closed and a
+// new one is started, welcome tells the client which happened.
+//
+// The AgentChanRPC is called with "DetachAgent" and the reason when the
+// connection of a session is lost and "ReattachAgent" when it is resumed,
+// "CloseAgent" is only called once the session ends, with ErrSessionExpired
+// if it was not resumed in time
+const (
+	frameHello   = 0x01
+	frameWelcome = 0x02
+	frameData    = 0x03
+	frameAck     = 0x04
+
+	tokenLen = 16
+)
+
+var ErrSessionExpired = errors.New("session expired")
+
+type sessionMsg struct {
+	seq  uint64
+	data [][]byte
+}
+
+type session struct {
+	gate     *Gate
+	token    string
+	mutex    sync.Mutex
+	conn     network.Conn
+	lastConn network.Conn
+	seq      uint64
+	buffer   []sessionMsg
+	expiry   *time.Timer
+	closed   bool
+	userData interface{}
+}
+
+// the connection of a session, a network.Agent
+type sessionConn struct {
+	conn      network.Conn
+	gate      *Gate
+	numAgents *metrics.Gauge
+	session   *session
+	reason    error
+	ip        string
+	limiter   *msgLimiter
+}
+
+func (gate *Gate) byteOrder() binary.ByteOrder {
+	if gate.LittleEndian {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+func (c *sessionConn) Run() {
+	c.reason = c.run()
+}
+
+// returns the reason the connection is closed
+func (c *sessionConn) run() error {
+	data, err := c.conn.ReadMsg()
+	if err != nil {
+		log.Debug("read message: %v", err)
+		return err
+	}
+	if len(data) < 9 || data[0] != frameHello ||
+		len(data) != 9 && len(data) != 9+tokenLen {
+		log.Debug("invalid hello from %v", c.conn.RemoteAddr())
+		return errors.New("invalid hello")
+	}
+	order := c.gate.byteOrder()
+	c.session = c.gate.bindSession(c.conn, string(data[9:]), order.Uint64(data[1:]))
+	if c.session == nil {
+		return ErrClosed
+	}
+
+	for {
+		data, err := c.conn.ReadMsg()
+		if err != nil {
+			log.Debug("read message: %v", err)
+			return err
+		}
+		if len(data) == 0 {
+			log.Debug("invalid frame from %v", c.conn.RemoteAddr())
+			return errors.New("invalid frame")
+		}
+
+		switch data[0] {
+		case frameData:
+			// the rate limits count the messages, not the acks
+			ok, err := c.limiter.check(data[1:])
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			err = c.gate.route(data[1:], c.session)
+			if err != nil {
+				return err
+			}
+		case frameAck:
+			if len(data) != 9 {
+				log.Debug("invalid ack from %v", c.conn.RemoteAddr())
+				return errors.New("invalid ack")
+			}
+			c.session.ack(order.Uint64(data[1:]))
+		default:
+			log.Debug("invalid frame type %v from %v", data[0], c.conn.RemoteAddr())
+			return fmt.Errorf("invalid frame type %v", data[0])
+		}
+	}
+}
+
+func (c *sessionConn) OnClose() {
+	c.numAgents.Dec()
+	c.gate.disconnect(c.ip)
+	if c.session != nil {
+		c.session.detach(c.conn, c.reason)
+	}
+}
+
+// resumes the session of token if the messages after lastAcked are still
+// buffered, starts a new session otherwise, a token of an unknown, expired
+// or closed session is logged
+func (gate *Gate) bindSession(conn network.Conn, token string, lastAcked uint64) *session {
+	gate.mutex.Lock()
+	if gate.closed {
+		gate.mutex.Unlock()
+		return nil
+	}
+	s := gate.sessions[token]
+	gate.mutex.Unlock()
+
+	if s != nil {
+		ok, detached, err := s.resume(conn, lastAcked)
+		if ok {
+			if detached && gate.AgentChanRPC != nil {
+				gate.AgentChanRPC.Go("ReattachAgent", s)
+			}
+			return s
+		}
+		if err != nil {
+			log.Release("resume session error: %v, new session started for %v", err, conn.RemoteAddr())
+			s.Close()
+		} else {
+			log.Release("session closed, new session started for %v", conn.RemoteAddr())
+		}
+	} else if token != "" {
+		log.Release("session not found or expired, new session started for %v", conn.RemoteAddr())
+	}
+
+	b := make([]byte, tokenLen)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Error("session token error: %v", err)
+		return nil
+	}
+	s = &session{gate: gate, token: string(b), conn: conn, lastConn: conn}
+
+	gate.mutex.Lock()
+	if gate.sessions == nil {
+		gate.sessions = make(map[string]*session)
+	}
+	gate.sessions[s.token] = s
+	gate.mutex.Unlock()
+	gate.addAgent(s)
+
+	s.mutex.Lock()
+	s.welcome(false)
+	s.mutex.Unlock()
+
+	if gate.AgentChanRPC != nil {
+		gate.AgentChanRPC.Go("NewAgent", s)
+	}
+	return s
+}
+
+func (gate *Gate) removeSession(s *session) {
+	gate.mutex.Lock()
+	delete(gate.sessions, s.token)
+	gate.mutex.Unlock()
+	gate.removeAgent(s)
+}
+
+// the sessions waiting for a reconnection when the gate closes
+func (gate *Gate) closeSessions() {
+	gate.mutex.Lock()
+	sessions := make([]*session, 0, len(gate.sessions))
+	for _, s := range gate.sessions {
+		sessions = append(sessions, s)
+	}
+	gate.mutex.Unlock()
+
+	for _, s := range sessions {
+		if s.shut(false) {
+			s.end(ErrClosed)
+		}
+	}
+}
+
+func (s *session) welcome(resumed bool) {
+	b := make([]byte, 2+tokenLen)
+	b[0] = frameWelcome
+	if resumed {
+		b[1] = 1
+	}
+	copy(b[2:], s.token)
+	s.conn.WriteMsg(b)
+}
+
+func (s *session) writeFrame(m *sessionMsg) {
+	header := make([]byte, 9)
+	header[0] = frameData
+	s.gate.byteOrder().PutUint64(header[1:], m.seq)
+	err := s.conn.WriteMsg(append([][]byte{header}, m.data...)...)
+	if err != nil {
+		log.Error("write message error: %v", err)
+	}
+}
+
+func (s *session) resume(conn network.Conn, lastAcked uint64) (ok bool, detached bool, err error) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return false, false, nil
+	}
+
+	first := s.seq + 1
+	if len(s.buffer) > 0 {
+		first = s.buffer[0].seq
+	}
+	if lastAcked > s.seq || lastAcked+1 < first {
+		s.mutex.Unlock()
+		return false, false, errors.New("missed messages are no longer buffered")
+	}
+
+	old := s.conn
+	s.conn = conn
+	s.lastConn = conn
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+
+	s.trim(lastAcked)
+	s.welcome(true)
+	for i := range s.buffer {
+		s.writeFrame(&s.buffer[i])
+	}
+	s.mutex.Unlock()
+
+	// the old connection is no longer the one of the session, its
+	// OnClose does not detach
+	if old != nil {
+		old.Close()
+	}
+	return true, old == nil, nil
+}
+
+// called with the mutex held
+func (s *session) trim(seq uint64) {
+	n := 0
+	for n < len(s.buffer) && s.buffer[n].seq <= seq {
+		n++
+	}
+	s.buffer = s.buffer[n:]
+}
+
+func (s *session) ack(seq uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.trim(seq)
+}
+
+func (s *session) detach(conn network.Conn, reason error) {
+	// the gate mutex is never taken with the session one held
+	s.gate.mutex.Lock()
+	gateClosed := s.gate.closed
+	s.gate.mutex.Unlock()
+
+	s.mutex.Lock()
+	if s.conn != conn {
+		s.mutex.Unlock()
+		return
+	}
+	s.conn = nil
+
+	if s.closed || gateClosed {
+		s.closed = true
+		s.mutex.Unlock()
+		s.end(ErrClosed)
+		return
+	}
+	s.expiry = time.AfterFunc(s.gate.SessionTimeout, s.expire)
+	s.mutex.Unlock()
+
+	if s.gate.AgentChanRPC != nil {
+		s.gate.AgentChanRPC.Go("DetachAgent", s, reason)
+	}
+}
+
+func (s *session) expire() {
+	s.mutex.Lock()
+	if s.conn != nil || s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	s.closed = true
+	s.mutex.Unlock()
+
+	s.end(ErrSessionExpired)
+}
+
+func (s *session) end(reason error) {
+	s.gate.removeSession(s)
+
+	if s.gate.AgentChanRPC != nil {
+		err := s.gate.AgentChanRPC.Call0("CloseAgent", s, reason)
+		if err != nil {
+			log.Error("chanrpc error: %v", err)
+		}
+	}
+}
+
+func (s *session) WriteMsg(msg interface{}) {
+	if s.gate.Processor == nil {
+		return
+	}
+	data, err := s.gate.Processor.Marshal(msg)
+	if err != nil {
+		log.Error("marshal message %v error: %v", reflect.TypeOf(msg), err)
+		return
+	}
+	s.writeData(data, nil)
+}
+
+func (s *session) owner() *Gate {
+	return s.gate
+}
+
+// data is shared by the sessions of a group, only the frame header is
+// made for each session, pm is not used
+func (s *session) writeData(data [][]byte, pm *network.PreparedMsg) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+
+	s.seq++
+	s.buffer = append(s.buffer, sessionMsg{seq: s.seq, data: data})
+	if s.gate.SessionBufferLen > 0 && len(s.buffer) > s.gate.SessionBufferLen {
+		s.buffer = s.buffer[len(s.buffer)-s.gate.SessionBufferLen:]
+	}
+	if s.conn != nil {
+		s.writeFrame(&s.buffer[len(s.buffer)-1])
+	}
+}
+
+func (s *session) LocalAddr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastConn.LocalAddr()
+}
+
+func (s *session) RemoteAddr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastConn.RemoteAddr()
+}
+
+// ends the session, it is not resumable
+func (s *session) Close() {
+	if s.shut(false) {
+		// may be called by the AgentChanRPC goroutine
+		go s.end(ErrClosed)
+	}
+}
+
+func (s *session) Destroy() {
+	if s.shut(true) {
+		go s.end(ErrClosed)
+	}
+}
+
+// true if the session is detached and must be ended by the caller,
+// otherwise OnClose of the connection ends it
+func (s *session) shut(destroy bool) bool {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return false
+	}
+	s.closed = true
+	conn := s.conn
+	if conn == nil && s.expiry != nil {
+		s.expiry.Stop()
+	}
+	s.mutex.Unlock()
+
+	if conn == nil {
+		return true
+	}
+	if destroy {
+		conn.Destroy()
+	} else {
+		conn.Close()
+	}
+	return false
+}
+
+func (s *session) UserData() interface{} {
+	return s.userData
+}
+
+func (s *session) SetUserData(data interface{}) {
+	s.userData = data
+}
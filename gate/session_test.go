@@ -0,0 +1,236 @@
+package gate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func (c *client) hello(lastAcked uint64, token string) {
+	c.t.Helper()
+	b := make([]byte, 9)
+	b[0] = frameHello
+	binary.BigEndian.PutUint64(b[1:], lastAcked)
+	c.write(b, []byte(token))
+}
+
+// returns the token
+func (c *client) welcome(resumed bool) string {
+	c.t.Helper()
+	b := c.read()
+	if len(b) != 2+tokenLen || b[0] != frameWelcome {
+		c.t.Fatalf("invalid welcome %v", b)
+	}
+	if (b[1] == 1) != resumed {
+		c.t.Fatalf("resumed %v, want %v", b[1], resumed)
+	}
+	return string(b[2:])
+}
+
+// a data frame of seq with Echo n
+func (c *client) data(seq uint64, n int) {
+	c.t.Helper()
+	b := c.read()
+	if len(b) < 9 || b[0] != frameData {
+		c.t.Fatalf("invalid data %v", b)
+	}
+	if s := binary.BigEndian.Uint64(b[1:]); s != seq {
+		c.t.Fatalf("seq %v, want %v", s, seq)
+	}
+	if msg := fmt.Sprintf(`{"Echo":{"N":%v}}`, n); !bytes.Equal(b[9:], []byte(msg)) {
+		c.t.Fatalf("message %s, want %s", b[9:], msg)
+	}
+}
+
+func (c *client) ack(seq uint64) {
+	b := make([]byte, 9)
+	b[0] = frameAck
+	binary.BigEndian.PutUint64(b[1:], seq)
+	c.write(b)
+}
+
+func (c *client) send(n int) {
+	c.write([]byte{frameData}, []byte(fmt.Sprintf(`{"Echo":{"N":%v}}`, n)))
+}
+
+// a new session with n messages written and read
+func (h *harness) connect(n int) (*client, string, Agent) {
+	h.t.Helper()
+	c := dial(h.t, h.gate.TCPAddr)
+	c.hello(0, "")
+	token := c.welcome(false)
+	a := h.expect("NewAgent").agent
+	for i := 1; i <= n; i++ {
+		a.WriteMsg(&Echo{i})
+		c.data(uint64(i), i)
+	}
+	return c, token, a
+}
+
+func TestSessionResume(t *testing.T) {
+	h := startGate(t, &Gate{TCPAddr: "127.0.0.1:37101", SessionTimeout: time.Second})
+	defer h.stop()
+
+	c, token, a := h.connect(3)
+	c.ack(1)
+	c.close()
+	if e := h.expect("DetachAgent"); e.agent != a || e.reason == nil {
+		t.Fatalf("DetachAgent %v, %v", e.agent, e.reason)
+	}
+	// written while detached
+	a.WriteMsg(&Echo{4})
+
+	// 3 and 4 are replayed
+	c = dial(t, h.gate.TCPAddr)
+	defer c.close()
+	c.hello(2, token)
+	if c.welcome(true) != token {
+		t.Fatal("token changed")
+	}
+	c.data(3, 3)
+	c.data(4, 4)
+	if e := h.expect("ReattachAgent"); e.agent != a {
+		t.Fatal("another agent reattached")
+	}
+
+	a.WriteMsg(&Echo{5})
+	c.data(5, 5)
+	c.send(6)
+	if m := h.expectMsg(); m.msg.N != 6 || m.agent != a {
+		t.Fatalf("routed %v", m)
+	}
+}
+
+// a resume with messages no longer buffered closes the old session
+func TestSessionBufferExhausted(t *testing.T) {
+	h := startGate(t, &Gate{TCPAddr: "127.0.0.1:37102", SessionTimeout: time.Second, SessionBufferLen: 2})
+	defer h.stop()
+
+	c, token, a := h.connect(5)
+	c.close()
+	h.expect("DetachAgent")
+
+	c = dial(t, h.gate.TCPAddr)
+	defer c.close()
+	c.hello(0, token)
+	if c.welcome(false) == token {
+		t.Fatal("token reused")
+	}
+	// ended asynchronously
+	var closed, created event
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-h.events:
+			if e.id == "CloseAgent" {
+				closed = e
+			} else if e.id == "NewAgent" {
+				created = e
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+		}
+	}
+	if closed.agent != a || closed.reason != ErrClosed {
+		t.Fatalf("CloseAgent %v, %v", closed.agent, closed.reason)
+	}
+	if created.agent == nil || created.agent == a {
+		t.Fatal("no new session")
+	}
+}
+
+func TestSessionExpire(t *testing.T) {
+	h := startGate(t, &Gate{TCPAddr: "127.0.0.1:37103", SessionTimeout: 50 * time.Millisecond})
+	defer h.stop()
+
+	c, token, a := h.connect(1)
+	c.close()
+	h.expect("DetachAgent")
+	if e := h.expect("CloseAgent"); e.agent != a || e.reason != ErrSessionExpired {
+		t.Fatalf("CloseAgent %v, %v", e.agent, e.reason)
+	}
+
+	// the token is forgotten
+	c = dial(t, h.gate.TCPAddr)
+	defer c.close()
+	c.hello(1, token)
+	c.welcome(false)
+	h.expect("NewAgent")
+}
+
+// CloseAgent is called once, the expiry is stopped
+func TestSessionCloseDetached(t *testing.T) {
+	h := startGate(t, &Gate{TCPAddr: "127.0.0.1:37104", SessionTimeout: 100 * time.Millisecond})
+	defer h.stop()
+
+	for _, destroy := range []bool{false, true} {
+		c, token, a := h.connect(1)
+		c.close()
+		h.expect("DetachAgent")
+		if destroy {
+			a.Destroy()
+		} else {
+			a.Close()
+		}
+		if e := h.expect("CloseAgent"); e.agent != a || e.reason != ErrClosed {
+			t.Fatalf("destroy %v: CloseAgent %v, %v", destroy, e.agent, e.reason)
+		}
+		h.expectNone(200 * time.Millisecond)
+
+		c = dial(t, h.gate.TCPAddr)
+		c.hello(1, token)
+		c.welcome(false)
+		h.expect("NewAgent")
+		c.close()
+		h.expect("DetachAgent")
+		h.expect("CloseAgent")
+	}
+}
+
+// the connected and the detached sessions end
+func TestSessionShutdown(t *testing.T) {
+	h := startGate(t, &Gate{TCPAddr: "127.0.0.1:37105", SessionTimeout: time.Hour})
+	defer h.stop()
+
+	c, _, detached := h.connect(0)
+	c.close()
+	h.expect("DetachAgent")
+	c, _, connected := h.connect(0)
+	defer c.close()
+
+	h.stop()
+	closed := make(map[Agent]error)
+	for i := 0; i < 2; i++ {
+		e := h.expect("CloseAgent")
+		closed[e.agent] = e.reason
+	}
+	if closed[detached] != ErrClosed || closed[connected] != ErrClosed {
+		t.Fatalf("CloseAgent %v", closed)
+	}
+}
+
+// the acks are not rate limited
+func TestSessionAckRate(t *testing.T) {
+	h := startGate(t, &Gate{
+		TCPAddr:         "127.0.0.1:37106",
+		SessionTimeout:  time.Second,
+		MsgRate:         1,
+		RateLimitAction: LimitDisconnect,
+	})
+	defer h.stop()
+
+	c, _, a := h.connect(5)
+	defer c.close()
+	for i := 1; i <= 5; i++ {
+		c.ack(uint64(i))
+	}
+	c.send(1)
+	if m := h.expectMsg(); m.agent != a {
+		t.Fatal("routed to another agent")
+	}
+	c.send(2)
+	if e := h.expect("DetachAgent"); e.reason != ErrRateLimited {
+		t.Fatalf("DetachAgent %v", e.reason)
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"github.com/name5566/leaf/conf"
 	"github.com/name5566/leaf/console"
 	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/metrics"
 	"github.com/name5566/leaf/module"
 	"os"
 	"os/signal"
+	"time"
 )
 
 func Run(mods ...module.Module) {
@@ -33,14 +35,46 @@ func Run(mods ...module.Module) {
 	cluster.Init()
 
 	// console
+	console.RegisterFunc("modules", "status of the modules", func([]string) string {
+		output := "Modules:"
+		for _, s := range module.Statuses() {
+			output += "\r\n" + s.String()
+		}
+		return output
+	})
 	console.Init()
 
+	// metrics
+	metrics.Init()
+
 	// close
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
-	sig := <-c
-	log.Release("Leaf closing down (signal: %v)", sig)
+	var sig os.Signal
+	select {
+	case sig = <-c:
+		log.Release("Leaf closing down (signal: %v)", sig)
+	case reason := <-module.ChanShutdown:
+		log.Release("Leaf closing down (%v)", reason)
+	}
+
+	drain(c)
+
+	metrics.Destroy()
 	console.Destroy()
 	cluster.Destroy()
 	module.Destroy()
 }
+
+// the modules are told to drain, then are given conf.ShutdownDrainTime
+// unless a signal is received
+func drain(c chan os.Signal) {
+	module.Drain()
+	if conf.ShutdownDrainTime > 0 {
+		select {
+		case <-time.After(conf.ShutdownDrainTime):
+		case sig := <-c:
+			log.Release("Leaf drain interrupted (signal: %v)", sig)
+		}
+	}
+}
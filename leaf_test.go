@@ -0,0 +1,29 @@
+package leaf
+
+import (
+	"github.com/name5566/leaf/conf"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDrainWindow(t *testing.T) {
+	drainTime := conf.ShutdownDrainTime
+	conf.ShutdownDrainTime = 100 * time.Millisecond
+	defer func() { conf.ShutdownDrainTime = drainTime }()
+
+	c := make(chan os.Signal, 1)
+	start := time.Now()
+	drain(c)
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("drained for %v", d)
+	}
+
+	// a second signal ends the window
+	c <- os.Interrupt
+	start = time.Now()
+	drain(c)
+	if d := time.Since(start); d >= 100*time.Millisecond {
+		t.Fatalf("drained for %v after a signal", d)
+	}
+}
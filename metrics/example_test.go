@@ -0,0 +1,52 @@
+package metrics_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/name5566/leaf/metrics"
+	"strings"
+)
+
+func Example() {
+	c := metrics.NewCounter("example_requests_total", "Number of requests.", "kind", "login")
+	c.Inc()
+	c.Add(2)
+
+	h := metrics.NewHistogram("example_latency_seconds", "Request latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+
+	var buf bytes.Buffer
+	metrics.Write(&buf)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "example_") {
+			fmt.Println(line)
+		}
+	}
+
+	// Output:
+	// example_latency_seconds_bucket{le="0.1"} 1
+	// example_latency_seconds_bucket{le="1"} 2
+	// example_latency_seconds_bucket{le="+Inf"} 2
+	// example_latency_seconds_sum 0.55
+	// example_latency_seconds_count 2
+	// example_requests_total{kind="login"} 3
+}
+
+func ExampleUnregister() {
+	n := 2
+	metrics.NewGaugeFunc("example_sessions", "Number of sessions.", func() float64 { return float64(n) })
+
+	var buf bytes.Buffer
+	metrics.Write(&buf)
+	fmt.Println(strings.Contains(buf.String(), "example_sessions 2"))
+
+	metrics.Unregister("example_sessions")
+	buf.Reset()
+	metrics.Write(&buf)
+	fmt.Println(strings.Contains(buf.String(), "example_sessions"))
+
+	// Output:
+	// true
+	// false
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/log"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+)
+
+var (
+	ln         net.Listener
+	httpServer *http.Server
+)
+
+func Init() {
+	if conf.MetricsAddr == "" {
+		return
+	}
+
+	var err error
+	ln, err = net.Listen("tcp", conf.MetricsAddr)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	httpServer = &http.Server{Handler: mux}
+
+	go httpServer.Serve(ln)
+}
+
+func Destroy() {
+	if httpServer != nil {
+		httpServer.Close()
+	}
+}
+
+// Prometheus text exposition format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Write(w)
+	})
+}
+
+// goroutine safe
+func Write(w io.Writer) {
+	writeFamilies(w)
+	writeRuntime(w)
+}
+
+func writeRuntime(w io.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	gauges := []struct {
+		name string
+		help string
+		v    float64
+	}{
+		{"go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine())},
+		{"go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(ms.Alloc)},
+		{"go_memstats_sys_bytes", "Number of bytes obtained from system.", float64(ms.Sys)},
+		{"go_memstats_heap_objects", "Number of allocated objects.", float64(ms.HeapObjects)},
+		{"go_memstats_next_gc_bytes", "Number of heap bytes when next garbage collection will take place.", float64(ms.NextGC)},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		writeSample(w, g.name, "", g.v)
+	}
+
+	fmt.Fprintf(w, "# HELP go_gc_cycles_total Number of completed GC cycles.\n# TYPE go_gc_cycles_total counter\n")
+	writeSample(w, "go_gc_cycles_total", "", float64(ms.NumGC))
+	fmt.Fprintf(w, "# HELP go_gc_pause_seconds_total Cumulative GC stop-the-world pause time.\n# TYPE go_gc_pause_seconds_total counter\n")
+	writeSample(w, "go_gc_pause_seconds_total", "", float64(ms.PauseTotalNs)/1e9)
+}
@@ -0,0 +1,237 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type metric interface {
+	write(w io.Writer, name string, labels string)
+}
+
+type family struct {
+	help   string
+	typ    string
+	series map[string]metric
+}
+
+var (
+	mutexFamilies sync.Mutex
+	families      = make(map[string]*family)
+)
+
+// labels are name-value pairs
+func formatLabels(labels []string) string {
+	if len(labels)%2 != 0 {
+		panic("labels must be name-value pairs")
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], v))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// returns the registered metric if name and labels are already in use
+func register(name string, help string, typ string, labels []string, m metric) metric {
+	l := formatLabels(labels)
+
+	mutexFamilies.Lock()
+	defer mutexFamilies.Unlock()
+
+	f := families[name]
+	if f == nil {
+		f = &family{help: help, typ: typ, series: make(map[string]metric)}
+		families[name] = f
+	} else if f.typ != typ {
+		panic(fmt.Sprintf("metric %v: registered as %v", name, f.typ))
+	}
+
+	if old, ok := f.series[l]; ok {
+		if _, ok := old.(*GaugeFunc); !ok {
+			return old
+		}
+	}
+	f.series[l] = m
+	return m
+}
+
+// removes the metric of name and labels, a GaugeFunc must be unregistered
+// once the state it reads is gone
+//
+// goroutine safe
+func Unregister(name string, labels ...string) {
+	l := formatLabels(labels)
+
+	mutexFamilies.Lock()
+	defer mutexFamilies.Unlock()
+
+	f := families[name]
+	if f == nil {
+		return
+	}
+	delete(f.series, l)
+	if len(f.series) == 0 {
+		delete(families, name)
+	}
+}
+
+func writeFamilies(w io.Writer) {
+	mutexFamilies.Lock()
+	defer mutexFamilies.Unlock()
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n", name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, f.typ)
+
+		labels := make([]string, 0, len(f.series))
+		for l := range f.series {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			f.series[l].write(w, name, l)
+		}
+	}
+}
+
+func writeSample(w io.Writer, name string, labels string, v float64) {
+	if labels == "" {
+		fmt.Fprintf(w, "%s %v\n", name, v)
+	} else {
+		fmt.Fprintf(w, "%s{%s} %v\n", name, labels, v)
+	}
+}
+
+// goroutine safe
+type Counter struct {
+	v uint64
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	return register(name, help, "counter", labels, new(Counter)).(*Counter)
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) write(w io.Writer, name string, labels string) {
+	writeSample(w, name, labels, float64(c.Value()))
+}
+
+// goroutine safe
+type Gauge struct {
+	v int64
+}
+
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	return register(name, help, "gauge", labels, new(Gauge)).(*Gauge)
+}
+
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.v, v)
+}
+
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.v, 1)
+}
+
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.v, -1)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+func (g *Gauge) write(w io.Writer, name string, labels string) {
+	writeSample(w, name, labels, float64(g.Value()))
+}
+
+// f is called on every scrape and must be goroutine safe
+type GaugeFunc struct {
+	f func() float64
+}
+
+// registering the same name and labels again replaces f
+func NewGaugeFunc(name string, help string, f func() float64, labels ...string) *GaugeFunc {
+	return register(name, help, "gauge", labels, &GaugeFunc{f: f}).(*GaugeFunc)
+}
+
+func (g *GaugeFunc) write(w io.Writer, name string, labels string) {
+	writeSample(w, name, labels, g.f())
+}
+
+// goroutine safe
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sumBits uint64
+}
+
+// buckets are upper bounds in increasing order, +Inf is implied
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := new(Histogram)
+	h.buckets = buckets
+	h.counts = make([]uint64, len(buckets))
+	return register(name, help, "histogram", labels, h).(*Histogram)
+}
+
+func (h *Histogram) Observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			atomic.AddUint64(&h.counts[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			break
+		}
+	}
+}
+
+func (h *Histogram) write(w io.Writer, name string, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+
+	var cumulative uint64
+	for i, b := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%v\"} %v\n", name, labels, sep, b, cumulative)
+	}
+	count := atomic.LoadUint64(&h.count)
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %v\n", name, labels, sep, count)
+	writeSample(w, name+"_sum", labels, math.Float64frombits(atomic.LoadUint64(&h.sumBits)))
+	writeSample(w, name+"_count", labels, float64(count))
+}
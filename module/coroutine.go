@@ -0,0 +1,156 @@
+package module
+
+import (
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/timer"
+	"runtime"
+	"time"
+)
+
+// Co is a coroutine of a skeleton. It runs in its own goroutine but only
+// while the skeleton goroutine waits for it, the two hand a token over so
+// that module code never runs in parallel. While a coroutine awaits, the
+// skeleton handles other events, the module state may change meanwhile
+type Co struct {
+	s      *Skeleton
+	resume chan struct{}
+	yield  chan struct{}
+}
+
+// f runs until it returns or awaits, Spawn must be called by the skeleton
+// goroutine or by a coroutine
+func (s *Skeleton) Spawn(f func(co *Co)) {
+	co := &Co{
+		s:      s,
+		resume: make(chan struct{}),
+		yield:  make(chan struct{}),
+	}
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if conf.LenStackBuf > 0 {
+					buf := make([]byte, conf.LenStackBuf)
+					l := runtime.Stack(buf, false)
+					log.Error("%v: %s", r, buf[:l])
+				} else {
+					log.Error("%v", r)
+				}
+			}
+			co.yield <- struct{}{}
+		}()
+
+		<-co.resume
+		f(co)
+	}()
+	co.switchTo()
+}
+
+// called by the token holder, returns when co awaits or returns
+func (co *Co) switchTo() {
+	co.resume <- struct{}{}
+	<-co.yield
+}
+
+// gives the token back and waits for a callback to call switchTo
+func (co *Co) suspend() {
+	co.yield <- struct{}{}
+	<-co.resume
+}
+
+// start issues an operation whose callback calls wake, the callback may
+// also be called before start returns, e.g. on "too many calls"
+func (co *Co) await(start func(wake func())) {
+	done := false
+	waiting := false
+	start(func() {
+		done = true
+		if waiting {
+			co.switchTo()
+		}
+	})
+	if !done {
+		waiting = true
+		co.suspend()
+	}
+}
+
+// f runs in another goroutine, like Skeleton.Go
+func (co *Co) Go(f func()) {
+	co.await(func(wake func()) {
+		co.s.Go(f, wake)
+	})
+}
+
+func withCb(args []interface{}, cb interface{}) []interface{} {
+	return append(args[:len(args):len(args)], cb)
+}
+
+func (co *Co) Call0(server *chanrpc.Server, id interface{}, args ...interface{}) error {
+	var err error
+	co.await(func(wake func()) {
+		co.s.AsynCall(server, id, withCb(args, func(e error) {
+			err = e
+			wake()
+		})...)
+	})
+	return err
+}
+
+func (co *Co) Call1(server *chanrpc.Server, id interface{}, args ...interface{}) (interface{}, error) {
+	var ret interface{}
+	var err error
+	co.await(func(wake func()) {
+		co.s.AsynCall(server, id, withCb(args, func(r interface{}, e error) {
+			ret, err = r, e
+			wake()
+		})...)
+	})
+	return ret, err
+}
+
+func (co *Co) CallN(server *chanrpc.Server, id interface{}, args ...interface{}) ([]interface{}, error) {
+	var ret []interface{}
+	var err error
+	co.await(func(wake func()) {
+		co.s.AsynCall(server, id, withCb(args, func(r []interface{}, e error) {
+			ret, err = r, e
+			wake()
+		})...)
+	})
+	return ret, err
+}
+
+// returns at once, or early, when the skeleton is closing
+func (co *Co) Sleep(d time.Duration) {
+	s := co.s
+	if s.closing {
+		return
+	}
+
+	co.await(func(wake func()) {
+		t := s.AfterFunc(d, func() {
+			delete(s.sleeping, co)
+			wake()
+		})
+		if s.sleeping == nil {
+			s.sleeping = make(map[*Co]*timer.Timer)
+		}
+		s.sleeping[co] = t
+	})
+}
+
+func (co *Co) Closing() bool {
+	return co.s.closing
+}
+
+// the sleeping coroutines are resumed so that they can finish
+func (s *Skeleton) wakeSleeping() {
+	for co, t := range s.sleeping {
+		t.Stop()
+		delete(s.sleeping, co)
+		co.switchTo()
+	}
+}
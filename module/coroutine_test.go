@@ -0,0 +1,159 @@
+package module
+
+import (
+	"github.com/name5566/leaf/chanrpc"
+	"testing"
+	"time"
+)
+
+func startSkeleton(t *testing.T) (*Skeleton, func()) {
+	s := &Skeleton{
+		GoLen:              10,
+		TimerDispatcherLen: 10,
+		AsynCallLen:        10,
+		ChanRPCServer:      chanrpc.NewServer(10),
+	}
+	s.Init()
+	s.RegisterChanRPC("spawn", func(args []interface{}) {
+		s.Spawn(args[0].(func(co *Co)))
+	})
+
+	closeSig := make(chan bool, 1)
+	done := make(chan struct{})
+	go func() {
+		s.Run(closeSig)
+		close(done)
+	}()
+	return s, func() {
+		closeSig <- true
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("skeleton not closed")
+		}
+	}
+}
+
+func remoteServer() (*chanrpc.Server, func()) {
+	server := chanrpc.NewServer(10)
+	server.Register("add", func(args []interface{}) interface{} {
+		return args[0].(int) + args[1].(int)
+	})
+	server.Register("slow", func(args []interface{}) {
+		time.Sleep(50 * time.Millisecond)
+	})
+	done := make(chan struct{})
+	go func() {
+		for ci := range server.ChanCall {
+			server.Exec(ci)
+		}
+		close(done)
+	}()
+	return server, func() {
+		server.Close()
+		<-done
+	}
+}
+
+func TestCoSleep(t *testing.T) {
+	s, stop := startSkeleton(t)
+	defer stop()
+
+	slept := make(chan time.Duration, 1)
+	s.ChanRPCServer.Go("spawn", func(co *Co) {
+		start := time.Now()
+		co.Sleep(30 * time.Millisecond)
+		slept <- time.Since(start)
+	})
+	if d := <-slept; d < 30*time.Millisecond {
+		t.Fatalf("slept %v", d)
+	}
+}
+
+func TestCoCall(t *testing.T) {
+	s, stop := startSkeleton(t)
+	defer stop()
+	server, closeServer := remoteServer()
+	defer closeServer()
+
+	type result struct {
+		ret interface{}
+		err error
+	}
+	results := make(chan result, 1)
+	s.ChanRPCServer.Go("spawn", func(co *Co) {
+		ret, err := co.Call1(server, "add", 1, 2)
+		results <- result{ret, err}
+	})
+	if r := <-results; r.ret != 3 || r.err != nil {
+		t.Fatalf("Call1: %v, %v", r.ret, r.err)
+	}
+}
+
+// the skeleton keeps handling events while a coroutine awaits Go, the
+// coroutine resumes holding the token, the race detector checks n
+func TestCoGo(t *testing.T) {
+	s, stop := startSkeleton(t)
+	defer stop()
+
+	n := 0
+	incs := make(chan int, 1)
+	s.RegisterChanRPC("inc", func(args []interface{}) {
+		n++
+		incs <- n
+	})
+
+	release := make(chan struct{})
+	ns := make(chan int, 1)
+	s.ChanRPCServer.Go("spawn", func(co *Co) {
+		n++
+		co.Go(func() {
+			<-release
+		})
+		n++
+		ns <- n
+	})
+
+	s.ChanRPCServer.Go("inc")
+	if n := <-incs; n != 2 {
+		t.Fatalf("n is %v in a handler", n)
+	}
+	close(release)
+	if n := <-ns; n != 3 {
+		t.Fatalf("n is %v in the coroutine", n)
+	}
+}
+
+// the suspended coroutines finish before Run returns
+func TestCoClose(t *testing.T) {
+	s, stop := startSkeleton(t)
+	server, closeServer := remoteServer()
+	defer closeServer()
+
+	closing := make(chan bool, 2)
+	started := make(chan struct{}, 2)
+	s.ChanRPCServer.Go("spawn", func(co *Co) {
+		started <- struct{}{}
+		co.Sleep(time.Hour)
+		closing <- co.Closing()
+	})
+	s.ChanRPCServer.Go("spawn", func(co *Co) {
+		started <- struct{}{}
+		co.Call0(server, "slow")
+		closing <- co.Closing()
+	})
+	<-started
+	<-started
+
+	stop()
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-closing:
+			if !c {
+				t.Fatal("coroutine resumed before closing")
+			}
+		default:
+			t.Fatal("coroutine not finished")
+		}
+	}
+}
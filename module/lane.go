@@ -0,0 +1,184 @@
+package module
+
+import (
+	"fmt"
+	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/metrics"
+	"time"
+)
+
+// the queues of a skeleton, served in this order by the weighted scheduler
+const (
+	laneCommand = iota
+	laneTimer
+	laneAsynRet
+	laneGo
+	laneChanRPC
+)
+
+type lane struct {
+	name   string
+	weight int
+	len    func() int
+	// takes one event without blocking, false if the queue is empty
+	poll        func() bool
+	lastServed  time.Time
+	starved     bool
+	starvations *metrics.Counter
+}
+
+func (s *Skeleton) initLanes() {
+	s.lanes = []*lane{
+		laneCommand: {name: "command", len: func() int { return len(s.commandServer.ChanCall) }, poll: func() bool {
+			select {
+			case ci := <-s.commandServer.ChanCall:
+				s.commandServer.Exec(ci)
+				return true
+			default:
+				return false
+			}
+		}},
+		laneTimer: {name: "timer", len: func() int { return len(s.dispatcher.ChanTimer) }, poll: func() bool {
+			select {
+			case t := <-s.dispatcher.ChanTimer:
+				t.Cb()
+				return true
+			default:
+				return false
+			}
+		}},
+		laneAsynRet: {name: "asynret", len: func() int { return len(s.client.ChanAsynRet) }, poll: func() bool {
+			select {
+			case ri := <-s.client.ChanAsynRet:
+				s.client.Cb(ri)
+				return true
+			default:
+				return false
+			}
+		}},
+		laneGo: {name: "go", len: func() int { return len(s.g.ChanCb) }, poll: func() bool {
+			select {
+			case cb := <-s.g.ChanCb:
+				s.g.Cb(cb)
+				return true
+			default:
+				return false
+			}
+		}},
+		laneChanRPC: {name: "chanrpc", len: func() int { return len(s.server.ChanCall) }, poll: func() bool {
+			select {
+			case ci := <-s.server.ChanCall:
+				s.server.Exec(ci)
+				return true
+			default:
+				return false
+			}
+		}},
+	}
+
+	weights := make(map[string]int, len(s.Weights))
+	for name, w := range s.Weights {
+		weights[name] = w
+	}
+	now := time.Now()
+	for _, l := range s.lanes {
+		l.weight = 1
+		if w, ok := weights[l.name]; ok {
+			if w <= 0 {
+				panic(fmt.Sprintf("invalid Weights: %v for queue %v", w, l.name))
+			}
+			l.weight = w
+			delete(weights, l.name)
+		}
+		l.lastServed = now
+	}
+	for name := range weights {
+		panic(fmt.Sprintf("invalid Weights: unknown queue %v", name))
+	}
+}
+
+func (s *Skeleton) served(i int) {
+	l := s.lanes[i]
+	if s.StarvationThreshold > 0 {
+		l.lastServed = time.Now()
+		l.starved = false
+	}
+}
+
+// only the events waiting in a buffered queue can be seen
+func (s *Skeleton) checkStarvation() {
+	if s.StarvationThreshold <= 0 {
+		return
+	}
+
+	now := time.Now()
+	for _, l := range s.lanes {
+		if l.len() == 0 {
+			l.lastServed = now
+			l.starved = false
+			continue
+		}
+		if l.starved || now.Sub(l.lastServed) < s.StarvationThreshold {
+			continue
+		}
+
+		// reported once until the queue is served
+		l.starved = true
+		if l.starvations != nil {
+			l.starvations.Inc()
+		}
+		name := s.Name
+		if name == "" {
+			name = "skeleton"
+		}
+		log.Release("%v: %v queue starved for %v, %v events pending",
+			name, l.name, now.Sub(l.lastServed), l.len())
+	}
+}
+
+// weighted round robin, every round each queue may be served up to its
+// weight, so a saturated ChanCall delays a timer by one round at most
+func (s *Skeleton) runWeighted(closeSig chan bool) {
+	for {
+		select {
+		case <-closeSig:
+			s.close()
+			return
+		default:
+		}
+
+		progressed := false
+		for i, l := range s.lanes {
+			for n := 0; n < l.weight && l.poll(); n++ {
+				s.served(i)
+				progressed = true
+			}
+		}
+		s.checkStarvation()
+		if progressed {
+			continue
+		}
+
+		// idle, wait for the next event of any queue
+		select {
+		case <-closeSig:
+			s.close()
+			return
+		case ci := <-s.commandServer.ChanCall:
+			s.commandServer.Exec(ci)
+			s.served(laneCommand)
+		case t := <-s.dispatcher.ChanTimer:
+			t.Cb()
+			s.served(laneTimer)
+		case ri := <-s.client.ChanAsynRet:
+			s.client.Cb(ri)
+			s.served(laneAsynRet)
+		case cb := <-s.g.ChanCb:
+			s.g.Cb(cb)
+			s.served(laneGo)
+		case ci := <-s.server.ChanCall:
+			s.server.Exec(ci)
+			s.served(laneChanRPC)
+		}
+	}
+}
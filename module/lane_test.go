@@ -0,0 +1,151 @@
+package module
+
+import (
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/log"
+	l "log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runSkeleton(t *testing.T, s *Skeleton) {
+	closeSig := make(chan bool, 1)
+	done := make(chan struct{})
+	go func() {
+		s.Run(closeSig)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		closeSig <- true
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("skeleton not closed")
+		}
+	})
+}
+
+// a timer and a command are served while ChanCall is saturated
+func TestWeightedSaturated(t *testing.T) {
+	s := &Skeleton{
+		TimerDispatcherLen: 10,
+		ChanRPCServer:      chanrpc.NewServer(1000),
+		Weights:            map[string]int{"chanrpc": 10},
+	}
+	s.Init()
+	s.RegisterChanRPC("busy", func(args []interface{}) {
+		time.Sleep(time.Millisecond)
+	})
+	served := make(chan string, 2)
+	s.commandServer.Register("cmd", func(args []interface{}) {
+		served <- "command"
+	})
+	for i := 0; i < 500; i++ {
+		s.server.Go("busy")
+	}
+	s.AfterFunc(10*time.Millisecond, func() {
+		served <- "timer"
+	})
+	runSkeleton(t, s)
+	go s.commandServer.Go("cmd")
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-served:
+		case <-time.After(200 * time.Millisecond):
+			t.Fatal("not served while ChanCall is saturated")
+		}
+	}
+	if n := len(s.server.ChanCall); n < 250 {
+		t.Fatalf("ChanCall drained to %v", n)
+	}
+}
+
+func TestWeightsInvalid(t *testing.T) {
+	for _, c := range []struct {
+		weights map[string]int
+		err     string
+	}{
+		{map[string]int{"timer": 0}, "invalid Weights: 0 for queue timer"},
+		{map[string]int{"go": -1}, "invalid Weights: -1 for queue go"},
+		{map[string]int{"unknown": 1}, "invalid Weights: unknown queue unknown"},
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r != c.err {
+					t.Fatalf("panic %v, want %v", r, c.err)
+				}
+			}()
+			s := &Skeleton{Weights: c.weights}
+			s.Init()
+		}()
+	}
+}
+
+// the timer queue is not served while a chanrpc call runs
+func TestStarvation(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := log.New("release", dir, l.LstdFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Export(logger)
+	defer func() {
+		stdout, _ := log.New("debug", "", l.LstdFlags)
+		log.Export(stdout)
+		logger.Close()
+	}()
+
+	s := &Skeleton{
+		Name:                "starvation_test",
+		TimerDispatcherLen:  10,
+		ChanRPCServer:       chanrpc.NewServer(10),
+		Weights:             map[string]int{},
+		StarvationThreshold: 20 * time.Millisecond,
+	}
+	s.Init()
+	// the counters are kept across runs of the test
+	base := make([]uint64, len(s.lanes))
+	for i, l := range s.lanes {
+		base[i] = l.starvations.Value()
+	}
+	fired := make(chan struct{})
+	s.RegisterChanRPC("block", func(args []interface{}) {
+		s.AfterFunc(time.Millisecond, func() {
+			close(fired)
+		})
+		time.Sleep(60 * time.Millisecond)
+	})
+	s.server.Go("block")
+	runSkeleton(t, s)
+
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("timer not fired")
+	}
+	for i, l := range s.lanes {
+		want := base[i]
+		if i == laneTimer {
+			want++
+		}
+		if n := l.starvations.Value(); n != want {
+			t.Fatalf("%v starvations %v, want %v", l.name, n, want)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(files) != 1 {
+		t.Fatalf("log files %v", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "starvation_test: timer queue starved for") {
+		t.Fatalf("log %q", data)
+	}
+}
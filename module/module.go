@@ -3,8 +3,10 @@ package module
 import (
 	"github.com/name5566/leaf/conf"
 	"github.com/name5566/leaf/log"
+	"os"
 	"runtime"
 	"sync"
+	"time"
 )
 
 type Module interface {
@@ -13,10 +15,20 @@ type Module interface {
 	Run(closeSig chan bool)
 }
 
+// a module can implement Drainer to be told that the server is about
+// to shut down, OnDrain is called before the drain window starts
+type Drainer interface {
+	OnDrain()
+}
+
 type module struct {
 	mi       Module
 	closeSig chan bool
 	wg       sync.WaitGroup
+	mutex    sync.Mutex
+	closing  bool
+	state    int
+	restarts int
 }
 
 var mods []*module
@@ -29,10 +41,14 @@ func Register(mi Module) {
 	//创建一个bool类型的通道，容量1
 	m.closeSig = make(chan bool, 1)
 	// 将创建的模块变量加入到模块列表中
+	mutexMods.Lock()
 	mods = append(mods, m)
+	mutexMods.Unlock()
 }
 
 func Init() {
+	sortMods()
+
 	for i := 0; i < len(mods); i++ {
 		mods[i].mi.OnInit()
 	}
@@ -44,20 +60,106 @@ func Init() {
 	}
 }
 
+func Drain() {
+	for i := len(mods) - 1; i >= 0; i-- {
+		if d, ok := mods[i].mi.(Drainer); ok {
+			drain(d)
+		}
+	}
+}
+
+// the process exits, replaced by the tests
+var exit = os.Exit
+
+// when conf.ShutdownTimeout passes before a module stopped or before its
+// OnDestroy returned, the module is logged along with the goroutine stacks
+// and the process exits with status 1, the other modules are not destroyed
 func Destroy() {
+	var deadline <-chan time.Time
+	if conf.ShutdownTimeout > 0 {
+		t := time.NewTimer(conf.ShutdownTimeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+
 	for i := len(mods) - 1; i >= 0; i-- {
 		m := mods[i]
 		// 向模块发送关闭信号
+		m.mutex.Lock()
+		m.closing = true
+		m.mutex.Unlock()
 		m.closeSig <- true
 		// 保证模块goroutine已经启动完成，与m.wg.Add(1),m.wg.Done()共同作用
-		m.wg.Wait()
-		destroy(m)
+		stopped := make(chan struct{})
+		go func() {
+			m.wg.Wait()
+			close(stopped)
+		}()
+		if !wait(stopped, deadline) {
+			timeout("module %v did not stop", m)
+			return
+		}
+
+		// OnDestroy does not race with Run
+		destroyed := make(chan struct{})
+		go func() {
+			destroy(m)
+			close(destroyed)
+		}()
+		if !wait(destroyed, deadline) {
+			timeout("OnDestroy of module %v did not return", m)
+			return
+		}
+	}
+}
+
+// false if the deadline passed first
+func wait(done <-chan struct{}, deadline <-chan time.Time) bool {
+	select {
+	case <-done:
+		return true
+	case <-deadline:
+	}
+	// done as the deadline passed
+	select {
+	case <-done:
+		return true
+	default:
+		return false
 	}
 }
 
-func run(m *module) {
-	m.mi.Run(m.closeSig)
-	m.wg.Done()
+func timeout(format string, m *module) {
+	log.Error(format+" before the shutdown timeout of %v", name(m.mi), conf.ShutdownTimeout)
+	log.Error("goroutine stacks: %s", stacks())
+	exit(1)
+}
+
+func stacks() []byte {
+	buf := make([]byte, 1<<16)
+	for {
+		l := runtime.Stack(buf, true)
+		if l < len(buf) {
+			return buf[:l]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+func drain(d Drainer) {
+	defer func() {
+		if r := recover(); r != nil {
+			if conf.LenStackBuf > 0 {
+				buf := make([]byte, conf.LenStackBuf)
+				l := runtime.Stack(buf, false)
+				log.Error("%v: %s", r, buf[:l])
+			} else {
+				log.Error("%v", r)
+			}
+		}
+	}()
+
+	d.OnDrain()
 }
 
 func destroy(m *module) {
@@ -0,0 +1,120 @@
+package module
+
+import (
+	"github.com/name5566/leaf/conf"
+	"testing"
+	"time"
+)
+
+// records the calls in calls, Run returns once stop is closed
+type stepModule struct {
+	name    string
+	calls   chan string
+	stop    chan struct{}
+	destroy chan struct{}
+}
+
+func (m *stepModule) OnInit() {}
+
+func (m *stepModule) OnDestroy() {
+	if m.destroy != nil {
+		<-m.destroy
+	}
+	m.calls <- m.name + " destroyed"
+}
+
+func (m *stepModule) Run(closeSig chan bool) {
+	<-closeSig
+	if m.stop != nil {
+		<-m.stop
+	}
+	m.calls <- m.name + " stopped"
+}
+
+func (m *stepModule) OnDrain() {
+	m.calls <- m.name + " drained"
+}
+
+// registers mis in place of the modules, exit is recorded in exits
+func setMods(t *testing.T, timeout time.Duration, mis ...Module) chan int {
+	oldMods, oldExit, oldTimeout := mods, exit, conf.ShutdownTimeout
+	t.Cleanup(func() {
+		mods, exit, conf.ShutdownTimeout = oldMods, oldExit, oldTimeout
+	})
+
+	exits := make(chan int, 1)
+	exit = func(code int) { exits <- code }
+	conf.ShutdownTimeout = timeout
+	mods = nil
+	for _, mi := range mis {
+		Register(mi)
+	}
+	Init()
+	return exits
+}
+
+func expectCalls(t *testing.T, calls chan string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case c := <-calls:
+			if c != w {
+				t.Fatalf("%v, want %v", c, w)
+			}
+		default:
+			t.Fatalf("no call, want %v", w)
+		}
+	}
+	select {
+	case c := <-calls:
+		t.Fatalf("unexpected %v", c)
+	default:
+	}
+}
+
+func TestDrain(t *testing.T) {
+	calls := make(chan string, 10)
+	setMods(t, time.Second, &stepModule{name: "a", calls: calls}, &stepModule{name: "b", calls: calls})
+
+	Drain()
+	expectCalls(t, calls, "b drained", "a drained")
+	Destroy()
+	expectCalls(t, calls, "b stopped", "b destroyed", "a stopped", "a destroyed")
+}
+
+// a module which did not stop is not destroyed, the process exits at the
+// deadline
+func TestDestroyTimeout(t *testing.T) {
+	calls := make(chan string, 10)
+	stuck := &stepModule{name: "b", calls: calls, stop: make(chan struct{})}
+	defer close(stuck.stop)
+	exits := setMods(t, 50*time.Millisecond, &stepModule{name: "a", calls: calls}, stuck)
+
+	start := time.Now()
+	Destroy()
+	if d := time.Since(start); d < 50*time.Millisecond || d > time.Second {
+		t.Fatalf("Destroy returned after %v", d)
+	}
+	select {
+	case code := <-exits:
+		if code != 1 {
+			t.Fatalf("exit %v", code)
+		}
+	default:
+		t.Fatal("no exit")
+	}
+	expectCalls(t, calls)
+}
+
+func TestDestroyTimeoutOnDestroy(t *testing.T) {
+	calls := make(chan string, 10)
+	stuck := &stepModule{name: "b", calls: calls, destroy: make(chan struct{})}
+	defer close(stuck.destroy)
+	exits := setMods(t, 50*time.Millisecond, &stepModule{name: "a", calls: calls}, stuck)
+
+	Destroy()
+	if len(exits) != 1 {
+		t.Fatal("no exit")
+	}
+	expectCalls(t, calls, "b stopped")
+}
@@ -0,0 +1,117 @@
+package module
+
+import (
+	"fmt"
+	"github.com/name5566/leaf/log"
+	"strings"
+)
+
+// a module can implement Dependent to be initialized after the modules
+// it depends on and destroyed before them. A module is named by Name if it
+// implements Dependent, by its type otherwise, as printed by %T, e.g.
+// "*game.Module", a type registered twice cannot be depended on
+type Dependent interface {
+	Name() string
+	Dependencies() []string
+}
+
+func name(mi Module) string {
+	if d, ok := mi.(Dependent); ok {
+		return d.Name()
+	}
+	return fmt.Sprintf("%T", mi)
+}
+
+func sortMods() {
+	sorted, err := sortModules(mods)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+	mutexMods.Lock()
+	mods = sorted
+	mutexMods.Unlock()
+}
+
+// modules without dependencies keep their registration order
+func sortModules(mods []*module) ([]*module, error) {
+	// -1 for the types registered twice
+	names := make(map[string]int)
+	for i, m := range mods {
+		n := name(m.mi)
+		_, dup := names[n]
+		if _, ok := m.mi.(Dependent); ok {
+			if dup {
+				return nil, fmt.Errorf("module %v is already registered", n)
+			}
+			names[n] = i
+		} else if dup {
+			names[n] = -1
+		} else {
+			names[n] = i
+		}
+	}
+
+	deps := make([][]int, len(mods))
+	for i, m := range mods {
+		d, ok := m.mi.(Dependent)
+		if !ok {
+			continue
+		}
+		for _, dep := range d.Dependencies() {
+			j, ok := names[dep]
+			if !ok {
+				return nil, fmt.Errorf("module %v depends on unknown module %v", d.Name(), dep)
+			}
+			if j < 0 {
+				return nil, fmt.Errorf("module %v depends on %v, which is registered more than once", d.Name(), dep)
+			}
+			deps[i] = append(deps[i], j)
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(mods))
+	sorted := make([]*module, 0, len(mods))
+	var path []int
+
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			var cycle []string
+			for k := len(path) - 1; k >= 0; k-- {
+				cycle = append([]string{name(mods[path[k]].mi)}, cycle...)
+				if path[k] == i {
+					break
+				}
+			}
+			cycle = append(cycle, name(mods[i].mi))
+			return fmt.Errorf("module dependency cycle: %v", strings.Join(cycle, " -> "))
+		}
+
+		state[i] = visiting
+		path = append(path, i)
+		for _, j := range deps[i] {
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		sorted = append(sorted, mods[i])
+		return nil
+	}
+
+	for i := range mods {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
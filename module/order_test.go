@@ -0,0 +1,109 @@
+package module
+
+import (
+	"testing"
+	"time"
+)
+
+type plainModule struct{}
+
+func (m *plainModule) OnInit()                {}
+func (m *plainModule) OnDestroy()             {}
+func (m *plainModule) Run(closeSig chan bool) {}
+
+type depModule struct {
+	plainModule
+	name string
+	deps []string
+}
+
+func (m *depModule) Name() string           { return m.name }
+func (m *depModule) Dependencies() []string { return m.deps }
+
+func sortNames(mis ...Module) ([]string, error) {
+	var ms []*module
+	for _, mi := range mis {
+		ms = append(ms, &module{mi: mi})
+	}
+	sorted, err := sortModules(ms)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, m := range sorted {
+		names = append(names, name(m.mi))
+	}
+	return names, nil
+}
+
+func TestSortModules(t *testing.T) {
+	names, err := sortNames(
+		&depModule{name: "db", deps: []string{"log"}},
+		&depModule{name: "log"},
+		&plainModule{},
+		&depModule{name: "game", deps: []string{"db", "*module.plainModule"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"log", "db", "*module.plainModule", "game"}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("order %v, want %v", names, want)
+		}
+	}
+}
+
+func TestSortModulesError(t *testing.T) {
+	for _, c := range []struct {
+		mis []Module
+		err string
+	}{
+		{
+			[]Module{&depModule{name: "a", deps: []string{"b"}}},
+			"module a depends on unknown module b",
+		},
+		{
+			[]Module{&depModule{name: "a"}, &depModule{name: "a"}},
+			"module a is already registered",
+		},
+		{
+			[]Module{&plainModule{}, &plainModule{}, &depModule{name: "a", deps: []string{"*module.plainModule"}}},
+			"module a depends on *module.plainModule, which is registered more than once",
+		},
+		{
+			[]Module{
+				&depModule{name: "a", deps: []string{"b"}},
+				&depModule{name: "b", deps: []string{"c"}},
+				&depModule{name: "c", deps: []string{"a"}},
+			},
+			"module dependency cycle: a -> b -> c -> a",
+		},
+	} {
+		_, err := sortNames(c.mis...)
+		if err == nil || err.Error() != c.err {
+			t.Fatalf("error %v, want %v", err, c.err)
+		}
+	}
+}
+
+type depStepModule struct {
+	stepModule
+	deps []string
+}
+
+func (m *depStepModule) OnInit()                { m.calls <- m.name + " initialized" }
+func (m *depStepModule) Name() string           { return m.name }
+func (m *depStepModule) Dependencies() []string { return m.deps }
+
+// destroyed in the reverse order of the initialization
+func TestDependencyTeardown(t *testing.T) {
+	calls := make(chan string, 10)
+	setMods(t, time.Second,
+		&depStepModule{stepModule{name: "b", calls: calls}, []string{"a"}},
+		&depStepModule{stepModule{name: "a", calls: calls}, nil},
+	)
+	expectCalls(t, calls, "a initialized", "b initialized")
+	Destroy()
+	expectCalls(t, calls, "b stopped", "b destroyed", "a stopped", "a destroyed")
+}
@@ -0,0 +1,150 @@
+package module
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/name5566/leaf/chanrpc"
+	"hash/fnv"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ShardedSkeleton runs Shards skeletons, each in its own goroutine. The
+// calls of ChanRPCServer are routed to a shard by the key of their
+// arguments, the calls sharing a key are executed in order by the same
+// shard while different keys may run in parallel.
+//
+// A function registered by RegisterChanRPC runs in the goroutine of its
+// shard, it must use Shard(key) for timers, Go and AsynCall
+type ShardedSkeleton struct {
+	// labels the metrics of the shards, no metrics are exported if empty
+	Name               string
+	Shards             int
+	GoLen              int
+	TimerDispatcherLen int
+	AsynCallLen        int
+	AsynCallTimeout    time.Duration
+	ChanRPCServer      *chanrpc.Server
+	// see Skeleton
+	Weights             map[string]int
+	StarvationThreshold time.Duration
+	// the routing key of a call, required. The agent of the messages routed
+	// by a gate is args[1], that of "NewAgent" and "CloseAgent" args[0].
+	// Integers and strings are spread by value, pointers by identity
+	Key       func(id interface{}, args []interface{}) interface{}
+	skeletons []*Skeleton
+}
+
+func (s *ShardedSkeleton) Init() {
+	if s.Shards <= 0 {
+		panic("invalid Shards")
+	}
+	if s.ChanRPCServer == nil {
+		panic("invalid ChanRPCServer")
+	}
+	if s.Key == nil {
+		panic("invalid Key")
+	}
+
+	s.skeletons = make([]*Skeleton, s.Shards)
+	for i := range s.skeletons {
+		skeleton := &Skeleton{
+			GoLen:               s.GoLen,
+			TimerDispatcherLen:  s.TimerDispatcherLen,
+			AsynCallLen:         s.AsynCallLen,
+			AsynCallTimeout:     s.AsynCallTimeout,
+			Weights:             s.Weights,
+			StarvationThreshold: s.StarvationThreshold,
+			// the calls routed to the shard, no function is registered
+			ChanRPCServer: chanrpc.NewServer(cap(s.ChanRPCServer.ChanCall)),
+		}
+		if s.Name != "" {
+			skeleton.Name = fmt.Sprintf("%v/%v", s.Name, i)
+		}
+		skeleton.Init()
+		s.skeletons[i] = skeleton
+	}
+}
+
+// a full shard blocks the routing of the calls to the other shards,
+// the shard queues have the capacity of ChanRPCServer
+func (s *ShardedSkeleton) Run(closeSig chan bool) {
+	var wg sync.WaitGroup
+	closeSigs := make([]chan bool, len(s.skeletons))
+	for i, skeleton := range s.skeletons {
+		closeSigs[i] = make(chan bool, 1)
+		wg.Add(1)
+		go func(skeleton *Skeleton, closeSig chan bool) {
+			defer wg.Done()
+			skeleton.Run(closeSig)
+		}(skeleton, closeSigs[i])
+	}
+
+	for {
+		select {
+		case <-closeSig:
+			s.ChanRPCServer.Close()
+			for _, c := range closeSigs {
+				c <- true
+			}
+			wg.Wait()
+			return
+		case ci := <-s.ChanRPCServer.ChanCall:
+			s.route(ci)
+		}
+	}
+}
+
+func (s *ShardedSkeleton) route(ci *chanrpc.CallInfo) {
+	key := s.Key(ci.ID(), ci.Args())
+	s.Shard(key).server.ChanCall <- ci
+}
+
+// the skeleton of the shard owning key
+func (s *ShardedSkeleton) Shard(key interface{}) *Skeleton {
+	return s.skeletons[shardOf(key, len(s.skeletons))]
+}
+
+func (s *ShardedSkeleton) NumShard() int {
+	return len(s.skeletons)
+}
+
+// integers are spread by value so that consecutive IDs land on different
+// shards, pointers by a hash of their address, which does not change
+// with what they point to, other keys by hash
+func shardOf(key interface{}, n int) int {
+	if key == nil {
+		return 0
+	}
+
+	v := reflect.ValueOf(key)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(uint64(v.Int()) % uint64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int(v.Uint() % uint64(n))
+	}
+
+	h := fnv.New64a()
+	switch v.Kind() {
+	case reflect.String:
+		h.Write([]byte(v.String()))
+	case reflect.Ptr, reflect.UnsafePointer, reflect.Chan, reflect.Map, reflect.Func:
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(v.Pointer()))
+		h.Write(b[:])
+	default:
+		fmt.Fprint(h, key)
+	}
+	return int(h.Sum64() % uint64(n))
+}
+
+func (s *ShardedSkeleton) RegisterChanRPC(id interface{}, f interface{}) {
+	s.ChanRPCServer.Register(id, f)
+}
+
+// commands run in the goroutine of the first shard
+func (s *ShardedSkeleton) RegisterCommand(name string, help string, f interface{}) {
+	s.skeletons[0].RegisterCommand(name, help, f)
+}
@@ -0,0 +1,99 @@
+package module
+
+import (
+	"github.com/name5566/leaf/chanrpc"
+	"sync"
+	"testing"
+)
+
+type player struct {
+	name string
+}
+
+func TestShardedOrder(t *testing.T) {
+	s := &ShardedSkeleton{
+		Shards:        4,
+		ChanRPCServer: chanrpc.NewServer(100),
+		Key: func(id interface{}, args []interface{}) interface{} {
+			return args[1]
+		},
+	}
+	s.Init()
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	seqs := make(map[*player][]int)
+	s.RegisterChanRPC("msg", func(args []interface{}) {
+		p := args[1].(*player)
+		mutex.Lock()
+		seqs[p] = append(seqs[p], args[0].(int))
+		mutex.Unlock()
+		// a message changing the player must not move it to another shard
+		p.name += "."
+		wg.Done()
+	})
+
+	closeSig := make(chan bool, 1)
+	done := make(chan struct{})
+	go func() {
+		s.Run(closeSig)
+		close(done)
+	}()
+
+	players := make([]*player, 8)
+	for i := range players {
+		players[i] = new(player)
+	}
+	for n := 0; n < 100; n++ {
+		for _, p := range players {
+			wg.Add(1)
+			s.ChanRPCServer.Go("msg", n, p)
+		}
+	}
+	wg.Wait()
+	closeSig <- true
+	<-done
+
+	for _, p := range players {
+		if len(seqs[p]) != 100 {
+			t.Fatalf("%v messages of a player", len(seqs[p]))
+		}
+		for i, n := range seqs[p] {
+			if n != i {
+				t.Fatalf("message %v handled at %v", n, i)
+			}
+		}
+	}
+}
+
+func TestShardOf(t *testing.T) {
+	const n = 4
+
+	// consecutive IDs land on every shard
+	for i := 0; i < n; i++ {
+		if shardOf(i, n) != i || shardOf(uint32(i), n) != i {
+			t.Fatalf("ID %v on shard %v", i, shardOf(i, n))
+		}
+	}
+
+	// pointers by identity, spread over the shards
+	counts := make([]int, n)
+	for i := 0; i < 1000; i++ {
+		p := &player{name: "same"}
+		shard := shardOf(p, n)
+		p.name = "changed"
+		if shardOf(p, n) != shard {
+			t.Fatal("a pointer moved to another shard")
+		}
+		counts[shard]++
+	}
+	for shard, c := range counts {
+		if c < 100 {
+			t.Fatalf("%v of 1000 pointers on shard %v", c, shard)
+		}
+	}
+
+	if shardOf("player", n) != shardOf("player", n) {
+		t.Fatal("a string moved to another shard")
+	}
+}
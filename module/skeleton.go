@@ -4,20 +4,35 @@ import (
 	"github.com/name5566/leaf/chanrpc"
 	"github.com/name5566/leaf/console"
 	"github.com/name5566/leaf/go"
+	"github.com/name5566/leaf/metrics"
 	"github.com/name5566/leaf/timer"
 	"time"
 )
 
 type Skeleton struct {
+	// labels the metrics of the skeleton, no metrics are exported if empty
+	Name               string
 	GoLen              int
 	TimerDispatcherLen int
 	AsynCallLen        int
+	AsynCallTimeout    time.Duration
 	ChanRPCServer      *chanrpc.Server
-	g                  *g.Go
-	dispatcher         *timer.Dispatcher
-	client             *chanrpc.Client
-	server             *chanrpc.Server
-	commandServer      *chanrpc.Server
+	// events taken from a queue in a row before the next queue is served,
+	// keyed by "command", "timer", "asynret", "go" and "chanrpc", a missing
+	// queue has weight 1 and a weight must be positive. nil means a random
+	// choice between the queues
+	Weights map[string]int
+	// a queue with pending events not served for StarvationThreshold is
+	// logged and counted, 0 means no report
+	StarvationThreshold time.Duration
+	g                   *g.Go
+	dispatcher          *timer.Dispatcher
+	client              *chanrpc.Client
+	server              *chanrpc.Server
+	commandServer       *chanrpc.Server
+	lanes               []*lane
+	closing             bool
+	sleeping            map[*Co]*timer.Timer
 }
 
 func (s *Skeleton) Init() {
@@ -34,35 +49,83 @@ func (s *Skeleton) Init() {
 	s.g = g.New(s.GoLen)
 	s.dispatcher = timer.NewDispatcher(s.TimerDispatcherLen)
 	s.client = chanrpc.NewClient(s.AsynCallLen)
+	s.client.AsynCallTimeout = s.AsynCallTimeout
 	s.server = s.ChanRPCServer
 
 	if s.server == nil {
 		s.server = chanrpc.NewServer(0)
 	}
 	s.commandServer = chanrpc.NewServer(0)
+
+	s.initLanes()
+	if s.Name != "" {
+		s.initMetrics()
+	}
+}
+
+func (s *Skeleton) initMetrics() {
+	for _, l := range s.lanes {
+		f := l.len
+		metrics.NewGaugeFunc("leaf_skeleton_queue_length",
+			"Number of events waiting in a skeleton queue.",
+			func() float64 { return float64(f()) },
+			"module", s.Name, "queue", l.name)
+		if s.StarvationThreshold > 0 {
+			l.starvations = metrics.NewCounter("leaf_skeleton_starvation_total",
+				"Number of times a skeleton queue was not served for the starvation threshold.",
+				"module", s.Name, "queue", l.name)
+		}
+	}
 }
 
+// Run can be called again after it panicked, as by the supervisor
+// restarting a module, the queues, timers, pending calls and coroutines are
+// kept as they were, nothing is reinitialized
 func (s *Skeleton) Run(closeSig chan bool) {
+	if s.Weights != nil {
+		s.runWeighted(closeSig)
+		return
+	}
+
 	for {
 		select {
 		case <-closeSig:
-			s.commandServer.Close()
-			s.server.Close()
-			for !s.g.Idle() || !s.client.Idle() {
-				s.g.Close()
-				s.client.Close()
-			}
+			s.close()
 			return
 		case ri := <-s.client.ChanAsynRet:
 			s.client.Cb(ri)
+			s.served(laneAsynRet)
 		case ci := <-s.server.ChanCall:
 			s.server.Exec(ci)
+			s.served(laneChanRPC)
 		case ci := <-s.commandServer.ChanCall:
 			s.commandServer.Exec(ci)
+			s.served(laneCommand)
 		case cb := <-s.g.ChanCb:
 			s.g.Cb(cb)
+			s.served(laneGo)
 		case t := <-s.dispatcher.ChanTimer:
 			t.Cb()
+			s.served(laneTimer)
+		}
+		s.checkStarvation()
+	}
+}
+
+// the coroutines awaiting a Go or an AsynCall are resumed by the
+// callbacks, the sleeping ones are woken up
+func (s *Skeleton) close() {
+	s.closing = true
+	s.commandServer.Close()
+	s.server.Close()
+	for !s.g.Idle() || !s.client.Idle() || len(s.sleeping) > 0 {
+		s.wakeSleeping()
+		s.g.Close()
+		s.client.Close()
+	}
+	if s.Name != "" {
+		for _, l := range s.lanes {
+			metrics.Unregister("leaf_skeleton_queue_length", "module", s.Name, "queue", l.name)
 		}
 	}
 }
@@ -108,6 +171,16 @@ func (s *Skeleton) AsynCall(server *chanrpc.Server, id interface{}, args ...inte
 	s.client.AsynCall(id, args...)
 }
 
+// f must arrange for done to be called exactly once, cb runs in the
+// skeleton goroutine, e.g. cluster.AsynCall(skeleton, ...)
+func (s *Skeleton) AsynCallFunc(f func(done func(interface{}, error)), cb interface{}) {
+	if s.AsynCallLen == 0 {
+		panic("invalid AsynCallLen")
+	}
+
+	s.client.AsynCallFunc(f, cb)
+}
+
 func (s *Skeleton) RegisterChanRPC(id interface{}, f interface{}) {
 	if s.ChanRPCServer == nil {
 		panic("invalid ChanRPCServer")
@@ -0,0 +1,175 @@
+package module
+
+import (
+	"fmt"
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/log"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// what to do when Run returns or panics before closeSig is sent
+const (
+	ActionIgnore = iota
+	ActionRestart
+	ActionShutdown
+)
+
+type Policy struct {
+	Action int
+	// restart backoff doubles from MinBackoff up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// a module can implement Supervised to choose its policy,
+// the others are left dead (ActionIgnore)
+type Supervised interface {
+	Policy() *Policy
+}
+
+const (
+	StateRunning = iota
+	StateRestarting
+	StateDead
+	StateStopped
+)
+
+var stateNames = []string{"running", "restarting", "dead", "stopped"}
+
+type Status struct {
+	Name     string
+	State    int
+	Restarts int
+}
+
+// receives a reason when a module escalates to a full shutdown
+var ChanShutdown = make(chan string, 1)
+
+func (s Status) String() string {
+	return fmt.Sprintf("%v - %v (restarts: %v)", s.Name, stateNames[s.State], s.Restarts)
+}
+
+// guards mods against Register and the sort of Init
+var mutexMods sync.Mutex
+
+// goroutine safe
+func Statuses() []Status {
+	mutexMods.Lock()
+	ms := append([]*module(nil), mods...)
+	mutexMods.Unlock()
+
+	statuses := make([]Status, len(ms))
+	for i, m := range ms {
+		m.mutex.Lock()
+		statuses[i] = Status{Name: name(m.mi), State: m.state, Restarts: m.restarts}
+		m.mutex.Unlock()
+	}
+	return statuses
+}
+
+func policy(mi Module) *Policy {
+	// the policy of the module is not modified
+	p := &Policy{Action: ActionIgnore}
+	if s, ok := mi.(Supervised); ok {
+		if sp := s.Policy(); sp != nil {
+			*p = *sp
+		}
+	}
+	if p.MinBackoff <= 0 {
+		p.MinBackoff = time.Second
+	}
+	if p.MaxBackoff < p.MinBackoff {
+		p.MaxBackoff = p.MinBackoff
+	}
+	return p
+}
+
+func (m *module) setState(state int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.state = state
+}
+
+func (m *module) isClosing() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.closing
+}
+
+func run(m *module) {
+	defer m.wg.Done()
+
+	p := policy(m.mi)
+	backoff := p.MinBackoff
+	for {
+		m.setState(StateRunning)
+		start := time.Now()
+		ok := runOnce(m)
+		if m.isClosing() {
+			m.setState(StateStopped)
+			return
+		}
+
+		// the stack of a panic was logged by runOnce
+		if ok {
+			log.Error("module %v exited unexpectedly: Run returned before closeSig", name(m.mi))
+		} else {
+			log.Error("module %v exited unexpectedly: Run panicked", name(m.mi))
+		}
+
+		switch p.Action {
+		case ActionRestart:
+		case ActionShutdown:
+			m.setState(StateDead)
+			select {
+			case ChanShutdown <- fmt.Sprintf("module %v exited", name(m.mi)):
+			default:
+			}
+			return
+		default:
+			m.setState(StateDead)
+			return
+		}
+
+		if time.Since(start) > p.MaxBackoff {
+			backoff = p.MinBackoff
+		}
+		m.mutex.Lock()
+		m.state = StateRestarting
+		m.restarts++
+		m.mutex.Unlock()
+		log.Release("restarting module %v in %v", name(m.mi), backoff)
+
+		select {
+		case <-m.closeSig:
+			m.setState(StateStopped)
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// false if Run panicked
+func runOnce(m *module) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			ok = false
+			if conf.LenStackBuf > 0 {
+				buf := make([]byte, conf.LenStackBuf)
+				l := runtime.Stack(buf, false)
+				log.Error("%v: %s", r, buf[:l])
+			} else {
+				log.Error("%v", r)
+			}
+		}
+	}()
+
+	m.mi.Run(m.closeSig)
+	return true
+}
@@ -0,0 +1,111 @@
+package module
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type flakyModule struct {
+	runs   chan time.Time
+	panics bool
+	policy *Policy
+}
+
+func (m *flakyModule) OnInit()    {}
+func (m *flakyModule) OnDestroy() {}
+
+func (m *flakyModule) Run(closeSig chan bool) {
+	m.runs <- time.Now()
+	if m.panics {
+		panic("flaky")
+	}
+}
+
+func (m *flakyModule) Policy() *Policy {
+	return m.policy
+}
+
+func startModule(mi Module) *module {
+	m := &module{mi: mi, closeSig: make(chan bool, 1)}
+	m.wg.Add(1)
+	go run(m)
+	return m
+}
+
+func stopModule(m *module) {
+	m.mutex.Lock()
+	m.closing = true
+	m.mutex.Unlock()
+	m.closeSig <- true
+	m.wg.Wait()
+}
+
+func status(m *module) (int, int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.state, m.restarts
+}
+
+func TestRestartBackoff(t *testing.T) {
+	for _, panics := range []bool{false, true} {
+		mi := &flakyModule{
+			runs:   make(chan time.Time, 10),
+			panics: panics,
+			policy: &Policy{Action: ActionRestart, MinBackoff: 20 * time.Millisecond, MaxBackoff: 80 * time.Millisecond},
+		}
+		m := startModule(mi)
+
+		// the backoff doubles up to MaxBackoff
+		last := <-mi.runs
+		for _, backoff := range []time.Duration{20, 40, 80, 80} {
+			backoff *= time.Millisecond
+			run := <-mi.runs
+			if d := run.Sub(last); d < backoff || d > 2*backoff {
+				t.Fatalf("panics %v: restarted after %v, want %v", panics, d, backoff)
+			}
+			last = run
+		}
+
+		stopModule(m)
+		if state, restarts := status(m); state != StateStopped || restarts < 4 {
+			t.Fatalf("panics %v: state %v, %v restarts", panics, stateNames[state], restarts)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	// ignored by default
+	mi := &flakyModule{runs: make(chan time.Time, 1), policy: &Policy{}}
+	m := startModule(mi)
+	m.wg.Wait()
+	if state, restarts := status(m); state != StateDead || restarts != 0 {
+		t.Fatalf("ignore: state %v, %v restarts", stateNames[state], restarts)
+	}
+
+	mi = &flakyModule{runs: make(chan time.Time, 1), panics: true, policy: &Policy{Action: ActionShutdown}}
+	m = startModule(mi)
+	select {
+	case reason := <-ChanShutdown:
+		if !strings.Contains(reason, "flakyModule") {
+			t.Fatalf("shutdown reason %q", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no shutdown")
+	}
+	m.wg.Wait()
+	if state, _ := status(m); state != StateDead {
+		t.Fatalf("shutdown: state %v", stateNames[state])
+	}
+}
+
+func TestPolicyCopy(t *testing.T) {
+	mi := &flakyModule{policy: &Policy{Action: ActionRestart}}
+	p := policy(mi)
+	if p.MinBackoff != time.Second || p.MaxBackoff != time.Second {
+		t.Fatalf("backoff %v to %v", p.MinBackoff, p.MaxBackoff)
+	}
+	if *mi.policy != (Policy{Action: ActionRestart}) {
+		t.Fatalf("policy of the module modified: %+v", *mi.policy)
+	}
+}
@@ -0,0 +1,70 @@
+package network
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+// With a compress threshold, the top bit of the len of a tcp frame tells
+// that the data is deflated, which halves the max message length:
+//
+//	-----------------------------
+//	| flag | len | deflated data |
+//	-----------------------------
+//
+// Compression is negotiated, a client announces it with a frame of the
+// flag and len 0, and compresses only once the server answered with the
+// same frame. A server answers only if it has a compress threshold, it
+// compresses for the clients which announced. A server without one skips
+// the frame and never answers, so the client does not compress, unless
+// its MaxMsgLen reaches the flag: the frame is then a message of that len
+var (
+	flateWriters = sync.Pool{New: func() interface{} {
+		// the level favors latency
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	}}
+	flateReaders = sync.Pool{New: func() interface{} {
+		return flate.NewReader(nil)
+	}}
+)
+
+func deflate(args [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+
+	w.Reset(&buf)
+	for i := 0; i < len(args); i++ {
+		if _, err := w.Write(args[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// at most maxMsgLen bytes are inflated
+func (p *MsgParser) inflate(data []byte) ([]byte, error) {
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(data), nil); err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(io.LimitReader(r, int64(p.maxMsgLen)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(b)) > p.maxMsgLen {
+		return nil, errors.New("message too long")
+	} else if uint32(len(b)) < p.minMsgLen {
+		return nil, errors.New("message too short")
+	}
+	return b, nil
+}
@@ -0,0 +1,300 @@
+package network
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the messages read by a conn, until the first error
+type testAgent struct {
+	conn Conn
+	msgs chan []byte
+	errs chan error
+}
+
+func newTestAgent(conn Conn, agents chan *testAgent) Agent {
+	a := &testAgent{conn: conn, msgs: make(chan []byte, 10), errs: make(chan error, 1)}
+	agents <- a
+	return a
+}
+
+func (a *testAgent) Run() {
+	for {
+		b, err := a.conn.ReadMsg()
+		if err != nil {
+			a.errs <- err
+			return
+		}
+		a.msgs <- b
+	}
+}
+
+func (a *testAgent) OnClose() {}
+
+func (a *testAgent) read(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case b := <-a.msgs:
+		return b
+	case err := <-a.errs:
+		t.Fatalf("read: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("no message")
+	}
+	return nil
+}
+
+func (a *testAgent) readErr(t *testing.T) error {
+	t.Helper()
+	select {
+	case b := <-a.msgs:
+		t.Fatalf("read a message of %v bytes", len(b))
+	case err := <-a.errs:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("no error")
+	}
+	return nil
+}
+
+func nextAgent(t *testing.T, agents chan *testAgent) *testAgent {
+	t.Helper()
+	select {
+	case a := <-agents:
+		return a
+	case <-time.After(time.Second):
+		t.Fatal("no connection")
+	}
+	return nil
+}
+
+func deflateBytes(t *testing.T, b []byte) []byte {
+	data, err := deflate([][]byte{b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// a tcp client without MsgParser, the len is 2 bytes big endian
+type rawConn struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (c *rawConn) write(flag uint16, data []byte) {
+	b := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(b, flag|uint16(len(data)))
+	copy(b[2:], data)
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+// returns the flag and the data
+func (c *rawConn) read() (uint16, []byte) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	n := binary.BigEndian.Uint16(header)
+	b := make([]byte, n&^0x8000)
+	if _, err := io.ReadFull(c.conn, b); err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return n & 0x8000, b
+}
+
+func startTCPServer(addr string, agents chan *testAgent) *TCPServer {
+	server := new(TCPServer)
+	server.Addr = addr
+	server.LenMsgLen = 2
+	server.MaxMsgLen = 1024
+	server.CompressThreshold = 16
+	server.NewAgent = func(conn *TCPConn) Agent {
+		return newTestAgent(conn, agents)
+	}
+	server.Start()
+	return server
+}
+
+func TestTCPCompress(t *testing.T) {
+	agents := make(chan *testAgent, 1)
+	server := startTCPServer("127.0.0.1:37141", agents)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &rawConn{t: t, conn: conn}
+	a := nextAgent(t, agents)
+	big := bytes.Repeat([]byte("leaf"), 100)
+
+	// not compressed before the client announced
+	a.conn.WriteMsg(big)
+	if flag, b := c.read(); flag != 0 || !bytes.Equal(b, big) {
+		t.Fatalf("flag %x, %v bytes", flag, len(b))
+	}
+
+	// the server answers
+	c.write(0x8000, nil)
+	if flag, b := c.read(); flag == 0 || len(b) != 0 {
+		t.Fatalf("flag %x, %v bytes", flag, len(b))
+	}
+
+	a.conn.WriteMsg(big)
+	flag, b := c.read()
+	if flag == 0 || len(b) >= len(big) {
+		t.Fatalf("flag %x, %v bytes", flag, len(b))
+	}
+	if b, err := io.ReadAll(flate.NewReader(bytes.NewReader(b))); err != nil || !bytes.Equal(b, big) {
+		t.Fatalf("inflate: %v bytes, %v", len(b), err)
+	}
+	// under the threshold
+	a.conn.WriteMsg([]byte("hi"))
+	if flag, b := c.read(); flag != 0 || string(b) != "hi" {
+		t.Fatalf("flag %x, %q", flag, b)
+	}
+
+	c.write(0x8000, deflateBytes(t, big))
+	if b := a.read(t); !bytes.Equal(b, big) {
+		t.Fatalf("read %v bytes", len(b))
+	}
+
+	// MaxMsgLen applies to the inflated bytes
+	c.write(0x8000, deflateBytes(t, make([]byte, 2000)))
+	if err := a.readErr(t); err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Fatalf("read: %v", err)
+	}
+}
+
+func TestTCPClientCompress(t *testing.T) {
+	agents := make(chan *testAgent, 2)
+	server := startTCPServer("127.0.0.1:37142", agents)
+	defer server.Close()
+
+	client := new(TCPClient)
+	client.Addr = server.Addr
+	client.LenMsgLen = 2
+	client.MaxMsgLen = 1024
+	client.CompressThreshold = 16
+	client.NewAgent = func(conn *TCPConn) Agent {
+		return newTestAgent(conn, agents)
+	}
+	client.Start()
+	defer client.Close()
+
+	// either can be first
+	a, b := nextAgent(t, agents), nextAgent(t, agents)
+	deadline := time.Now().Add(time.Second)
+	for !a.conn.(*TCPConn).compressing() || !b.conn.(*TCPConn).compressing() {
+		if time.Now().After(deadline) {
+			t.Fatal("compression not negotiated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	big := bytes.Repeat([]byte("leaf"), 100)
+	a.conn.WriteMsg(big[:200], big[200:])
+	if m := b.read(t); !bytes.Equal(m, big) {
+		t.Fatalf("read %v bytes", len(m))
+	}
+	b.conn.WriteMsg(big)
+	if m := a.read(t); !bytes.Equal(m, big) {
+		t.Fatalf("read %v bytes", len(m))
+	}
+}
+
+func TestWSCompress(t *testing.T) {
+	agents := make(chan *testAgent, 1)
+	server := new(WSServer)
+	server.Addr = "127.0.0.1:37143"
+	server.MaxMsgLen = 1024
+	server.CompressThreshold = 16
+	server.NewAgent = func(conn *WSConn) Agent {
+		return newTestAgent(conn, agents)
+	}
+	server.Start()
+	defer server.Close()
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, _, err := dialer.Dial("ws://"+server.Addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.EnableWriteCompression(true)
+	a := nextAgent(t, agents)
+	big := bytes.Repeat([]byte("leaf"), 100)
+
+	conn.WriteMessage(websocket.BinaryMessage, big)
+	if b := a.read(t); !bytes.Equal(b, big) {
+		t.Fatalf("read %v bytes", len(b))
+	}
+	a.conn.WriteMsg(big)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, b, err := conn.ReadMessage(); err != nil || !bytes.Equal(b, big) {
+		t.Fatalf("read %v bytes, %v", len(b), err)
+	}
+
+	// deflated under MaxMsgLen, inflated over it
+	conn.WriteMessage(websocket.BinaryMessage, make([]byte, 100000))
+	if err := a.readErr(t); err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Fatalf("read: %v", err)
+	}
+}
+
+// a server without CompressThreshold skips the announcement of a client,
+// which then does not compress
+func TestTCPCompressDeclined(t *testing.T) {
+	for i, lenMsgLen := range []int{2, 4} {
+		agents := make(chan *testAgent, 2)
+		server := new(TCPServer)
+		server.Addr = fmt.Sprintf("127.0.0.1:%v", 37144+i)
+		server.LenMsgLen = lenMsgLen
+		server.MaxMsgLen = 1024
+		server.NewAgent = func(conn *TCPConn) Agent {
+			return newTestAgent(conn, agents)
+		}
+		server.Start()
+
+		client := new(TCPClient)
+		client.Addr = server.Addr
+		client.LenMsgLen = lenMsgLen
+		client.MaxMsgLen = 1024
+		client.CompressThreshold = 16
+		client.NewAgent = func(conn *TCPConn) Agent {
+			return newTestAgent(conn, agents)
+		}
+		client.Start()
+
+		a, b := nextAgent(t, agents), nextAgent(t, agents)
+		big := bytes.Repeat([]byte("leaf"), 100)
+		a.conn.WriteMsg(big)
+		if m := b.read(t); !bytes.Equal(m, big) {
+			t.Fatalf("read %v bytes", len(m))
+		}
+		b.conn.WriteMsg(big)
+		if m := a.read(t); !bytes.Equal(m, big) {
+			t.Fatalf("read %v bytes", len(m))
+		}
+		if a.conn.(*TCPConn).compressing() || b.conn.(*TCPConn).compressing() {
+			t.Fatalf("compressing with LenMsgLen %v", lenMsgLen)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,53 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// returned by ReadMsg when nothing was read for the read idle timeout
+var ErrReadIdle = errors.New("read idle timeout")
+
+func idleError(err error) error {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return ErrReadIdle
+	}
+	return err
+}
+
+// writes the messages of writeChan until a nil one, with writeIdle > 0 ping
+// is called after writeIdle without writing
+func writeLoop(writeChan chan []byte, writeIdle time.Duration, write func([]byte) error, ping func() error) {
+	var t *time.Timer
+	var idle <-chan time.Time
+	if writeIdle > 0 {
+		t = time.NewTimer(writeIdle)
+		defer t.Stop()
+		idle = t.C
+	}
+
+	for {
+		select {
+		case b := <-writeChan:
+			if b == nil || write(b) != nil {
+				return
+			}
+			if t != nil {
+				if !t.Stop() {
+					select {
+					case <-t.C:
+					default:
+					}
+				}
+				t.Reset(writeIdle)
+			}
+		case <-idle:
+			if ping() != nil {
+				return
+			}
+			t.Reset(writeIdle)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package network
+
+import (
+	"github.com/name5566/leaf/metrics"
+)
+
+type connMetrics struct {
+	msgsIn        *metrics.Counter
+	msgsOut       *metrics.Counter
+	bytesIn       *metrics.Counter
+	bytesOut      *metrics.Counter
+	chanFull      *metrics.Counter
+	writeChanFill *metrics.Histogram
+}
+
+var (
+	tcpMetrics = newConnMetrics("tcp")
+	wsMetrics  = newConnMetrics("ws")
+)
+
+func newConnMetrics(conn string) *connMetrics {
+	m := new(connMetrics)
+	m.msgsIn = metrics.NewCounter("leaf_network_received_messages_total",
+		"Number of messages read from connections.", "conn", conn)
+	m.msgsOut = metrics.NewCounter("leaf_network_sent_messages_total",
+		"Number of messages written to connections.", "conn", conn)
+	m.bytesIn = metrics.NewCounter("leaf_network_received_bytes_total",
+		"Number of message bytes read from connections.", "conn", conn)
+	m.bytesOut = metrics.NewCounter("leaf_network_sent_bytes_total",
+		"Number of message bytes written to connections.", "conn", conn)
+	m.chanFull = metrics.NewCounter("leaf_network_write_chan_full_total",
+		"Number of connections closed because the write channel was full.", "conn", conn)
+	m.writeChanFill = metrics.NewHistogram("leaf_network_write_chan_fill_ratio",
+		"Fill ratio of the write channel observed on every write.",
+		[]float64{0.1, 0.25, 0.5, 0.75, 0.9, 1}, "conn", conn)
+	return m
+}
+
+func (m *connMetrics) observeWriteChan(l int, c int) {
+	if c > 0 {
+		m.writeChanFill.Observe(float64(l) / float64(c))
+	}
+}
@@ -0,0 +1,67 @@
+package network
+
+import (
+	"sync"
+)
+
+// A message written to several connections. The frame of a TCPConn is
+// built, and compressed, once for each compression setting, at most twice,
+// the connections of another MsgParser build their own. The args of a
+// WSConn are merged once
+//
+// goroutine safe
+type PreparedMsg struct {
+	args   [][]byte
+	msgLen uint32
+	mutex  sync.Mutex
+	merged []byte
+	parser *MsgParser
+	frames [2][]byte
+	errs   [2]error
+}
+
+// args must not be modified by the others goroutines
+func NewPreparedMsg(args ...[]byte) *PreparedMsg {
+	pm := new(PreparedMsg)
+	pm.args = args
+	for i := 0; i < len(args); i++ {
+		pm.msgLen += uint32(len(args[i]))
+	}
+	return pm
+}
+
+func (pm *PreparedMsg) frame(p *MsgParser, compress bool) ([]byte, error) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if pm.parser != nil && pm.parser != p {
+		return p.frame(compress, pm.args...)
+	}
+	pm.parser = p
+
+	i := 0
+	if compress {
+		i = 1
+	}
+	if pm.frames[i] == nil && pm.errs[i] == nil {
+		pm.frames[i], pm.errs[i] = p.frame(compress, pm.args...)
+	}
+	return pm.frames[i], pm.errs[i]
+}
+
+func (pm *PreparedMsg) bytes() []byte {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if pm.merged == nil {
+		if len(pm.args) == 1 {
+			pm.merged = pm.args[0]
+		} else {
+			pm.merged = make([]byte, 0, pm.msgLen)
+			for i := 0; i < len(pm.args); i++ {
+				pm.merged = append(pm.merged, pm.args[i]...)
+			}
+		}
+	}
+	return pm.merged
+}
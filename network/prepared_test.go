@@ -0,0 +1,40 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPreparedMsg(t *testing.T) {
+	p := NewMsgParser()
+	p.SetCompressThreshold(16)
+	data := bytes.Repeat([]byte("leaf"), 64)
+	pm := NewPreparedMsg(data[:100], data[100:])
+
+	// built once for each compression
+	plain, err := pm.frame(p, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := pm.frame(p, false); &again[0] != &plain[0] {
+		t.Fatal("uncompressed frame built twice")
+	}
+	deflated, _ := pm.frame(p, true)
+	if again, _ := pm.frame(p, true); &again[0] != &deflated[0] {
+		t.Fatal("compressed frame built twice")
+	}
+	if len(plain) != 2+len(data) || len(deflated) >= len(plain) {
+		t.Fatalf("frames of %v and %v bytes", len(plain), len(deflated))
+	}
+
+	// another parser frames its own
+	other := NewMsgParser()
+	other.SetMsgLen(4, 0, 0)
+	if b, _ := pm.frame(other, false); len(b) != 4+len(data) {
+		t.Fatalf("frame of %v bytes", len(b))
+	}
+
+	if b := pm.bytes(); !bytes.Equal(b, data) {
+		t.Fatal("invalid merged bytes")
+	}
+}
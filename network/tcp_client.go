@@ -25,6 +25,16 @@ type TCPClient struct {
 	MaxMsgLen    uint32
 	LittleEndian bool
 	msgParser    *MsgParser
+
+	// heartbeat, see TCPServer, the heartbeats of the server are answered
+	ReadIdleTimeout  time.Duration
+	WriteIdleTimeout time.Duration
+	Heartbeat        bool
+
+	// announces compression, see compress.go, the server compresses only
+	// if it has a CompressThreshold too. The top bit of the len is the
+	// compress flag, MaxMsgLen is at most half the max len
+	CompressThreshold uint32
 }
 
 func (client *TCPClient) Start() {
@@ -66,6 +76,8 @@ func (client *TCPClient) init() {
 	msgParser := NewMsgParser()
 	msgParser.SetMsgLen(client.LenMsgLen, client.MinMsgLen, client.MaxMsgLen)
 	msgParser.SetByteOrder(client.LittleEndian)
+	msgParser.heartbeat = client.Heartbeat || client.ReadIdleTimeout > 0 || client.WriteIdleTimeout > 0
+	msgParser.SetCompressThreshold(client.CompressThreshold)
 	client.msgParser = msgParser
 }
 
@@ -100,7 +112,12 @@ reconnect:
 	client.conns[conn] = struct{}{}
 	client.Unlock()
 
-	tcpConn := newTCPConn(conn, client.PendingWriteNum, client.msgParser)
+	tcpConn := newTCPConn(conn, client.PendingWriteNum, client.msgParser, client.ReadIdleTimeout, client.WriteIdleTimeout)
+	tcpConn.pong = client.msgParser.heartbeat
+	if client.CompressThreshold > 0 {
+		tcpConn.announced = true
+		tcpConn.Write(client.msgParser.compressFrame())
+	}
 	agent := client.NewAgent(tcpConn)
 	agent.Run()
 
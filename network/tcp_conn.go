@@ -4,6 +4,8 @@ import (
 	"github.com/name5566/leaf/log"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ConnSet map[net.Conn]struct{}	// 定义一个ConnSet类型实际为一个net.Conn到空对象的映射
@@ -14,27 +16,30 @@ type TCPConn struct {
 	writeChan chan []byte		// 写通道
 	closeFlag bool				// 关闭标识符
 	msgParser *MsgParser		// 消息解释器
+	readIdle  time.Duration		// 读空闲超时
+	pong      bool				// 收到心跳时是否回复
+	compress  int32				// 是否已协商压缩
+	announced bool				// 是否由本端发起压缩协商
 }
 
 // 初始化一个TCPConn，pendingWriteNum为写通道的容量
-func newTCPConn(conn net.Conn, pendingWriteNum int, msgParser *MsgParser) *TCPConn {
+// readIdle > 0 时ReadMsg在readIdle内没有读到任何帧会返回ErrReadIdle，writeIdle > 0 时在writeIdle内没有写出数据会发送一个心跳
+func newTCPConn(conn net.Conn, pendingWriteNum int, msgParser *MsgParser, readIdle, writeIdle time.Duration) *TCPConn {
 	tcpConn := new(TCPConn)
 	tcpConn.conn = conn
 	tcpConn.writeChan = make(chan []byte, pendingWriteNum)
 	tcpConn.msgParser = msgParser
+	tcpConn.readIdle = readIdle
 	// 开启一个协程，从writechan中不断的接受数据，然后发送出去
 	go func() {
 		// 当tcpConn关闭时会向tcpConn.writeChan中发送一个nil
-		for b := range tcpConn.writeChan {
-			if b == nil {
-				break
-			}
-
+		writeLoop(tcpConn.writeChan, writeIdle, func(b []byte) error {
 			_, err := conn.Write(b)
-			if err != nil {
-				break
-			}
-		}
+			return err
+		}, func() error {
+			_, err := conn.Write(msgParser.heartbeatFrame())
+			return err
+		})
 		// 当发送完成后，关闭连接，并且将tcpConn的closeFlag设置为true，表示writeChan已关闭
 		conn.Close()
 		tcpConn.Lock()
@@ -73,26 +78,35 @@ func (tcpConn *TCPConn) Close() {
 	tcpConn.closeFlag = true
 }
 
-func (tcpConn *TCPConn) doWrite(b []byte) {
+// 写通道已满时销毁连接并返回false
+func (tcpConn *TCPConn) doWrite(b []byte) bool {
+	tcpMetrics.observeWriteChan(len(tcpConn.writeChan), cap(tcpConn.writeChan))
 	if len(tcpConn.writeChan) == cap(tcpConn.writeChan) {
 		log.Debug("close conn: channel full")
+		tcpMetrics.chanFull.Inc()
 		tcpConn.doDestroy()
-		return
+		return false
 	}
 
 	tcpConn.writeChan <- b
+	return true
 }
 
 // b must not be modified by the others goroutines
 // 通过调用do_write,将信息b发送到writeChan中
 func (tcpConn *TCPConn) Write(b []byte) {
+	tcpConn.write(b)
+}
+
+// 返回b是否进入了writeChan
+func (tcpConn *TCPConn) write(b []byte) bool {
 	tcpConn.Lock()
 	defer tcpConn.Unlock()
 	if tcpConn.closeFlag || b == nil {
-		return
+		return false
 	}
 
-	tcpConn.doWrite(b)
+	return tcpConn.doWrite(b)
 }
 
 //
@@ -107,13 +121,80 @@ func (tcpConn *TCPConn) LocalAddr() net.Addr {
 func (tcpConn *TCPConn) RemoteAddr() net.Addr {
 	return tcpConn.conn.RemoteAddr()
 }
-// 通过调用MsgParser的Read方法，读取数据。
+// 通过调用MsgParser的Read方法，读取数据。心跳帧会被跳过，需要回复时回复一个心跳
 func (tcpConn *TCPConn) ReadMsg() ([]byte, error) {
-	return tcpConn.msgParser.Read(tcpConn)
+	for {
+		if tcpConn.readIdle > 0 {
+			tcpConn.conn.SetReadDeadline(time.Now().Add(tcpConn.readIdle))
+		}
+		data, compressed, err := tcpConn.msgParser.read(tcpConn)
+		if err != nil {
+			return nil, idleError(err)
+		}
+		if compressed {
+			if len(data) == 0 {
+				tcpConn.negotiate()
+				continue
+			}
+			data, err = tcpConn.msgParser.inflate(data)
+			if err != nil {
+				return nil, err
+			}
+		} else if len(data) == 0 {
+			if tcpConn.pong {
+				tcpConn.Write(tcpConn.msgParser.heartbeatFrame())
+			}
+			continue
+		}
+
+		tcpMetrics.msgsIn.Inc()
+		tcpMetrics.bytesIn.Add(uint64(len(data)))
+		return data, nil
+	}
+}
+
+// 收到压缩协商帧后开启压缩，没有发起协商的一端需要回复。没有压缩阈值时不回复，即拒绝压缩
+func (tcpConn *TCPConn) negotiate() {
+	if tcpConn.msgParser.compressThreshold == 0 {
+		return
+	}
+	if atomic.SwapInt32(&tcpConn.compress, 1) == 0 && !tcpConn.announced {
+		tcpConn.Write(tcpConn.msgParser.compressFrame())
+	}
+}
+
+func (tcpConn *TCPConn) compressing() bool {
+	return atomic.LoadInt32(&tcpConn.compress) == 1
 }
 
 // 先通过msgParser的Write将信息按照协议封装，在msgParser.Wirte中会调用TCPConn的Write，最终实现将封装好的信息发送到
 // writeChan中，详细参考tcp_msg中MsgParser的Write方法
+// 只统计进入了writeChan的msg
 func (tcpConn *TCPConn) WriteMsg(args ...[]byte) error {
-	return tcpConn.msgParser.Write(tcpConn, args...)
+	msg, err := tcpConn.msgParser.frame(tcpConn.compressing(), args...)
+	if err != nil {
+		return err
+	}
+
+	if tcpConn.write(msg) {
+		tcpMetrics.msgsOut.Inc()
+		for i := 0; i < len(args); i++ {
+			tcpMetrics.bytesOut.Add(uint64(len(args[i])))
+		}
+	}
+	return nil
+}
+
+// 与WriteMsg相同，帧由所有连接共用，参见PreparedMsg
+func (tcpConn *TCPConn) WritePreparedMsg(pm *PreparedMsg) error {
+	msg, err := pm.frame(tcpConn.msgParser, tcpConn.compressing())
+	if err != nil {
+		return err
+	}
+
+	if tcpConn.write(msg) {
+		tcpMetrics.msgsOut.Inc()
+		tcpMetrics.bytesOut.Add(uint64(pm.msgLen))
+	}
+	return nil
 }
@@ -3,6 +3,7 @@ package network
 import (
 	"encoding/binary"
 	"errors"
+	"github.com/name5566/leaf/log"
 	"io"
 	"math"
 )
@@ -15,6 +16,8 @@ type MsgParser struct {
 	minMsgLen    uint32		// 最小msg长度
 	maxMsgLen    uint32		// 最大msg长度
 	littleEndian bool		// 大小端
+	heartbeat    bool		// 长度为0的帧是否为心跳
+	compressThreshold uint32	// 大于0时压缩不小于该长度的msg，参见compress.go
 }
 // 创建一个消息解析器
 func NewMsgParser() *MsgParser {
@@ -63,15 +66,42 @@ func (p *MsgParser) SetByteOrder(littleEndian bool) {
 	p.littleEndian = littleEndian
 }
 
+// It's dangerous to call the method on reading or writing
+// 设置压缩阈值，0代表不压缩。len的最高位用作压缩标识，maxMsgLen最大为len能表示的最大值的一半（lenMsgLen为2时是32767），
+// 超过时会被减小并记录日志，需要在SetMsgLen之后调用
+func (p *MsgParser) SetCompressThreshold(threshold uint32) {
+	p.compressThreshold = threshold
+	if threshold > 0 && p.maxMsgLen >= p.compressFlag() {
+		p.maxMsgLen = p.compressFlag() - 1
+		log.Release("invalid MaxMsgLen with compression, reset to %v", p.maxMsgLen)
+	}
+}
+
+// len的最高位
+func (p *MsgParser) compressFlag() uint32 {
+	return 1 << uint(p.lenMsgLen*8-1)
+}
+
 // goroutine safe
-// 因为conn实现了Read方法，所以Read方法会通过io:ReadFull来读取conn的数据,io:ReadFull最终会调用conn.Read来获取数据,参考io:ReadFull源码
+// 读取一个msg，压缩的msg会被解压
 func (p *MsgParser) Read(conn *TCPConn) ([]byte, error) {
+	data, compressed, err := p.read(conn)
+	if err != nil || !compressed || len(data) == 0 {
+		return data, err
+	}
+	return p.inflate(data)
+}
+
+// goroutine safe
+// 因为conn实现了Read方法，所以Read方法会通过io:ReadFull来读取conn的数据,io:ReadFull最终会调用conn.Read来获取数据,参考io:ReadFull源码
+// compressed为true时data是压缩过的，长度为0时是压缩协商帧
+func (p *MsgParser) read(conn *TCPConn) (data []byte, compressed bool, err error) {
 	var b [4]byte
 	bufMsgLen := b[:p.lenMsgLen]
 
 	// read len  读取len大小的字节
 	if _, err := io.ReadFull(conn, bufMsgLen); err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	// parse len 通过解析获取包的长度len
@@ -93,24 +123,50 @@ func (p *MsgParser) Read(conn *TCPConn) ([]byte, error) {
 		}
 	}
 
-	// check len 检查len大小，是不是在规定的min到max之间
+	// 压缩标识
+	if p.compressThreshold > 0 && msgLen&p.compressFlag() != 0 {
+		msgLen &^= p.compressFlag()
+		compressed = true
+	} else if msgLen == p.compressFlag() && msgLen > p.maxMsgLen {
+		// 不压缩时也识别压缩协商帧，它不可能是一个msg时才识别
+		return []byte{}, true, nil
+	}
+
+	// 心跳帧或压缩协商帧，返回一个空的msg
+	if msgLen == 0 && (p.heartbeat || compressed) {
+		return []byte{}, compressed, nil
+	}
+
+	// check len 检查len大小，是不是在规定的min到max之间，压缩的msg在解压后检查
 	if msgLen > p.maxMsgLen {
-		return nil, errors.New("message too long")
-	} else if msgLen < p.minMsgLen {
-		return nil, errors.New("message too short")
+		return nil, false, errors.New("message too long")
+	} else if msgLen < p.minMsgLen && !compressed {
+		return nil, false, errors.New("message too short")
 	}
 
 	// data 读取len大小的数据
 	msgData := make([]byte, msgLen)
 	if _, err := io.ReadFull(conn, msgData); err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	return msgData, nil
+	return msgData, compressed, nil
 }
 
 // goroutine safe
 func (p *MsgParser) Write(conn *TCPConn, args ...[]byte) error {
+	msg, err := p.frame(conn.compressing(), args...)
+	if err != nil {
+		return err
+	}
+
+	conn.Write(msg)
+
+	return nil
+}
+
+// 将msg按照协议封装成一帧，compress为true时压缩不小于阈值的msg，压缩后没有变小则不压缩
+func (p *MsgParser) frame(compress bool, args ...[]byte) ([]byte, error) {
 	// get len  获取msg的len
 	var msgLen uint32
 	for i := 0; i < len(args); i++ {
@@ -119,14 +175,38 @@ func (p *MsgParser) Write(conn *TCPConn, args ...[]byte) error {
 
 	// check len 检测len是否在min和max之间
 	if msgLen > p.maxMsgLen {
-		return errors.New("message too long")
+		return nil, errors.New("message too long")
 	} else if msgLen < p.minMsgLen {
-		return errors.New("message too short")
+		return nil, errors.New("message too short")
+	}
+
+	var flag uint32
+	if compress && p.compressThreshold > 0 && msgLen >= p.compressThreshold {
+		data, err := deflate(args)
+		if err == nil && uint32(len(data)) < msgLen {
+			args = [][]byte{data}
+			msgLen = uint32(len(data))
+			flag = p.compressFlag()
+		}
 	}
+
 	// 根据len和data大小申请msg buf
 	msg := make([]byte, uint32(p.lenMsgLen)+msgLen)
 
 	// write len 根据大小端和len的字节长度，向msg buf中写入len
+	p.putLen(msg, msgLen|flag)
+
+	// write data 将data写入到msg buf中
+	l := p.lenMsgLen
+	for i := 0; i < len(args); i++ {
+		copy(msg[l:], args[i])
+		l += len(args[i])
+	}
+
+	return msg, nil
+}
+
+func (p *MsgParser) putLen(msg []byte, msgLen uint32) {
 	switch p.lenMsgLen {
 	case 1:
 		msg[0] = byte(msgLen)
@@ -143,15 +223,16 @@ func (p *MsgParser) Write(conn *TCPConn, args ...[]byte) error {
 			binary.BigEndian.PutUint32(msg, msgLen)
 		}
 	}
+}
 
-	// write data 将data写入到msg buf中
-	l := p.lenMsgLen
-	for i := 0; i < len(args); i++ {
-		copy(msg[l:], args[i])
-		l += len(args[i])
-	}
-
-	conn.Write(msg)
+// 心跳帧，即一个长度为0的帧，所有字节序下都是全0
+func (p *MsgParser) heartbeatFrame() []byte {
+	return make([]byte, p.lenMsgLen)
+}
 
-	return nil
+// 压缩协商帧，即一个只有压缩标识的长度为0的帧
+func (p *MsgParser) compressFrame() []byte {
+	msg := make([]byte, p.lenMsgLen)
+	p.putLen(msg, p.compressFlag())
+	return msg
 }
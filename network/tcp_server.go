@@ -24,6 +24,13 @@ type TCPServer struct {
 	MaxMsgLen    uint32
 	LittleEndian bool
 	msgParser    *MsgParser
+
+	// heartbeat，两者之一大于0时长度为0的帧为心跳，客户端需要用一个心跳回复服务器发出的心跳，服务器不回复心跳
+	ReadIdleTimeout  time.Duration	// 超过该时间没有收到任何帧则关闭连接
+	WriteIdleTimeout time.Duration	// 超过该时间没有发送数据则发送一个心跳
+
+	// 大于0时与发起协商的客户端压缩不小于该长度的msg，参见compress.go。len的最高位用作压缩标识，MaxMsgLen最大为len能表示的最大值的一半
+	CompressThreshold uint32
 }
 // TCPServer的启动接口
 func (server *TCPServer) Start() {
@@ -58,6 +65,8 @@ func (server *TCPServer) init() {
 	msgParser := NewMsgParser()
 	msgParser.SetMsgLen(server.LenMsgLen, server.MinMsgLen, server.MaxMsgLen)
 	msgParser.SetByteOrder(server.LittleEndian)
+	msgParser.heartbeat = server.ReadIdleTimeout > 0 || server.WriteIdleTimeout > 0
+	msgParser.SetCompressThreshold(server.CompressThreshold)
 	server.msgParser = msgParser
 }
 
@@ -101,7 +110,7 @@ func (server *TCPServer) run() {
 
 		server.wgConns.Add(1)
 		// 将TCPServer的conn、msgParser、PendingWriteNum封装到tcpConn中
-		tcpConn := newTCPConn(conn, server.PendingWriteNum, server.msgParser)
+		tcpConn := newTCPConn(conn, server.PendingWriteNum, server.msgParser, server.ReadIdleTimeout, server.WriteIdleTimeout)
 		// 通过tcpConn生成Agent
 		agent := server.NewAgent(tcpConn)
 		// 启动一个协程执行Agent的Run方法(Run的实现参见leafServer gate模块)
@@ -119,6 +128,12 @@ func (server *TCPServer) run() {
 		}()
 	}
 }
+// stops accepting new connections, the accepted ones are kept
+func (server *TCPServer) CloseListener() {
+	server.ln.Close()
+	server.wgLn.Wait()
+}
+
 // 关闭连接
 func (server *TCPServer) Close() {
 	server.ln.Close()
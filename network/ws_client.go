@@ -17,10 +17,14 @@ type WSClient struct {
 	HandshakeTimeout time.Duration
 	AutoReconnect    bool
 	NewAgent         func(*WSConn) Agent
-	dialer           websocket.Dialer
-	conns            WebsocketConnSet
-	wg               sync.WaitGroup
-	closeFlag        bool
+	// see WSServer
+	ReadIdleTimeout   time.Duration
+	WriteIdleTimeout  time.Duration
+	CompressThreshold uint32
+	dialer            websocket.Dialer
+	conns             WebsocketConnSet
+	wg                sync.WaitGroup
+	closeFlag         bool
 }
 
 func (client *WSClient) Start() {
@@ -66,7 +70,8 @@ func (client *WSClient) init() {
 	client.conns = make(WebsocketConnSet)
 	client.closeFlag = false
 	client.dialer = websocket.Dialer{
-		HandshakeTimeout: client.HandshakeTimeout,
+		HandshakeTimeout:  client.HandshakeTimeout,
+		EnableCompression: client.CompressThreshold > 0,
 	}
 }
 
@@ -102,7 +107,7 @@ reconnect:
 	client.conns[conn] = struct{}{}
 	client.Unlock()
 
-	wsConn := newWSConn(conn, client.PendingWriteNum, client.MaxMsgLen)
+	wsConn := newWSConn(conn, client.PendingWriteNum, client.MaxMsgLen, client.ReadIdleTimeout, client.WriteIdleTimeout, client.CompressThreshold)
 	agent := client.NewAgent(wsConn)
 	agent.Run()
 
@@ -4,8 +4,10 @@ import (
 	"errors"
 	"github.com/gorilla/websocket"
 	"github.com/name5566/leaf/log"
+	"io"
 	"net"
 	"sync"
+	"time"
 )
 
 type WebsocketConnSet map[*websocket.Conn]struct{}
@@ -16,25 +18,50 @@ type WSConn struct {
 	writeChan chan []byte
 	maxMsgLen uint32
 	closeFlag bool
+	readIdle  time.Duration
+	// set by WSServer.RealIPHeader
+	remoteAddr net.Addr
 }
 
-func newWSConn(conn *websocket.Conn, pendingWriteNum int, maxMsgLen uint32) *WSConn {
+// with readIdle > 0, ReadMsg fails with ErrReadIdle when neither a message
+// nor a control frame is read for readIdle, with writeIdle > 0 a ping frame
+// is written after writeIdle without writing. With compressThreshold > 0,
+// the messages of at least compressThreshold bytes are compressed if
+// permessage-deflate was negotiated
+func newWSConn(conn *websocket.Conn, pendingWriteNum int, maxMsgLen uint32, readIdle, writeIdle time.Duration, compressThreshold uint32) *WSConn {
 	wsConn := new(WSConn)
 	wsConn.conn = conn
 	wsConn.writeChan = make(chan []byte, pendingWriteNum)
 	wsConn.maxMsgLen = maxMsgLen
-
-	go func() {
-		for b := range wsConn.writeChan {
-			if b == nil {
-				break
+	wsConn.readIdle = readIdle
+
+	if readIdle > 0 {
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(readIdle))
+		})
+		conn.SetPingHandler(func(data string) error {
+			conn.SetReadDeadline(time.Now().Add(readIdle))
+			// as the default handler
+			err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+			if err == websocket.ErrCloseSent {
+				return nil
 			}
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return nil
+			}
+			return err
+		})
+	}
 
-			err := conn.WriteMessage(websocket.BinaryMessage, b)
-			if err != nil {
-				break
+	go func() {
+		writeLoop(wsConn.writeChan, writeIdle, func(b []byte) error {
+			if compressThreshold > 0 {
+				conn.EnableWriteCompression(uint32(len(b)) >= compressThreshold)
 			}
-		}
+			return conn.WriteMessage(websocket.BinaryMessage, b)
+		}, func() error {
+			return conn.WriteMessage(websocket.PingMessage, nil)
+		})
 
 		conn.Close()
 		wsConn.Lock()
@@ -73,14 +100,18 @@ func (wsConn *WSConn) Close() {
 	wsConn.closeFlag = true
 }
 
-func (wsConn *WSConn) doWrite(b []byte) {
+// false if the conn was destroyed, the channel being full
+func (wsConn *WSConn) doWrite(b []byte) bool {
+	wsMetrics.observeWriteChan(len(wsConn.writeChan), cap(wsConn.writeChan))
 	if len(wsConn.writeChan) == cap(wsConn.writeChan) {
 		log.Debug("close conn: channel full")
+		wsMetrics.chanFull.Inc()
 		wsConn.doDestroy()
-		return
+		return false
 	}
 
 	wsConn.writeChan <- b
+	return true
 }
 
 func (wsConn *WSConn) LocalAddr() net.Addr {
@@ -88,13 +119,33 @@ func (wsConn *WSConn) LocalAddr() net.Addr {
 }
 
 func (wsConn *WSConn) RemoteAddr() net.Addr {
+	if wsConn.remoteAddr != nil {
+		return wsConn.remoteAddr
+	}
 	return wsConn.conn.RemoteAddr()
 }
 
 // goroutine not safe
 func (wsConn *WSConn) ReadMsg() ([]byte, error) {
-	_, b, err := wsConn.conn.ReadMessage()
-	return b, err
+	if wsConn.readIdle > 0 {
+		wsConn.conn.SetReadDeadline(time.Now().Add(wsConn.readIdle))
+	}
+	_, r, err := wsConn.conn.NextReader()
+	if err != nil {
+		return nil, idleError(err)
+	}
+	// the read limit of the conn applies to the deflated bytes
+	b, err := io.ReadAll(io.LimitReader(r, int64(wsConn.maxMsgLen)+1))
+	if err != nil {
+		return nil, idleError(err)
+	}
+	if uint32(len(b)) > wsConn.maxMsgLen {
+		return nil, errors.New("message too long")
+	}
+
+	wsMetrics.msgsIn.Inc()
+	wsMetrics.bytesIn.Add(uint64(len(b)))
+	return b, nil
 }
 
 // args must not be modified by the others goroutines
@@ -119,20 +170,46 @@ func (wsConn *WSConn) WriteMsg(args ...[]byte) error {
 	}
 
 	// don't copy
-	if len(args) == 1 {
-		wsConn.doWrite(args[0])
+	msg := args[0]
+	if len(args) > 1 {
+		// merge the args
+		msg = make([]byte, msgLen)
+		l := 0
+		for i := 0; i < len(args); i++ {
+			copy(msg[l:], args[i])
+			l += len(args[i])
+		}
+	}
+
+	if wsConn.doWrite(msg) {
+		wsMetrics.msgsOut.Inc()
+		wsMetrics.bytesOut.Add(uint64(msgLen))
+	}
+
+	return nil
+}
+
+// as WriteMsg, the merged args are shared, see PreparedMsg
+func (wsConn *WSConn) WritePreparedMsg(pm *PreparedMsg) error {
+	msg := pm.bytes()
+
+	wsConn.Lock()
+	defer wsConn.Unlock()
+	if wsConn.closeFlag {
 		return nil
 	}
 
-	// merge the args
-	msg := make([]byte, msgLen)
-	l := 0
-	for i := 0; i < len(args); i++ {
-		copy(msg[l:], args[i])
-		l += len(args[i])
+	// check len
+	if uint32(len(msg)) > wsConn.maxMsgLen {
+		return errors.New("message too long")
+	} else if len(msg) < 1 {
+		return errors.New("message too short")
 	}
 
-	wsConn.doWrite(msg)
+	if wsConn.doWrite(msg) {
+		wsMetrics.msgsOut.Inc()
+		wsMetrics.bytesOut.Add(uint64(len(msg)))
+	}
 
 	return nil
 }
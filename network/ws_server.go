@@ -6,6 +6,7 @@ import (
 	"github.com/name5566/leaf/log"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -19,14 +20,30 @@ type WSServer struct {
 	CertFile        string
 	KeyFile         string
 	NewAgent        func(*WSConn) Agent
-	ln              net.Listener
-	handler         *WSHandler
+	// closes the connections silent for ReadIdleTimeout, a ping frame is
+	// written after WriteIdleTimeout without writing
+	ReadIdleTimeout  time.Duration
+	WriteIdleTimeout time.Duration
+	// permessage-deflate is offered, the messages of at least
+	// CompressThreshold bytes are compressed, 0 disables compression
+	CompressThreshold uint32
+	// behind a reverse proxy, the remote address of a connection is the
+	// last address of the RealIPHeader of its request, e.g. X-Forwarded-For,
+	// the one the proxy added. Only for servers reachable through the proxy
+	// alone, a client could forge it otherwise
+	RealIPHeader string
+	ln           net.Listener
+	handler      *WSHandler
 }
 
 type WSHandler struct {
 	maxConnNum      int
 	pendingWriteNum int
 	maxMsgLen       uint32
+	readIdle        time.Duration
+	writeIdle       time.Duration
+	compress        uint32
+	realIPHeader    string
 	newAgent        func(*WSConn) Agent
 	upgrader        websocket.Upgrader
 	conns           WebsocketConnSet
@@ -64,7 +81,10 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	handler.conns[conn] = struct{}{}
 	handler.mutexConns.Unlock()
 
-	wsConn := newWSConn(conn, handler.pendingWriteNum, handler.maxMsgLen)
+	wsConn := newWSConn(conn, handler.pendingWriteNum, handler.maxMsgLen, handler.readIdle, handler.writeIdle, handler.compress)
+	if handler.realIPHeader != "" {
+		wsConn.remoteAddr = realIP(r, handler.realIPHeader)
+	}
 	agent := handler.newAgent(wsConn)
 	agent.Run()
 
@@ -76,6 +96,21 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	agent.OnClose()
 }
 
+// the last address of header, nil if there is none
+func realIP(r *http.Request, header string) net.Addr {
+	values := r.Header.Values(header)
+	if len(values) == 0 {
+		return nil
+	}
+	addrs := strings.Split(values[len(values)-1], ",")
+	ip := net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1]))
+	if ip == nil {
+		log.Debug("invalid %v from %v", header, r.RemoteAddr)
+		return nil
+	}
+	return &net.TCPAddr{IP: ip}
+}
+
 func (server *WSServer) Start() {
 	ln, err := net.Listen("tcp", server.Addr)
 	if err != nil {
@@ -121,11 +156,16 @@ func (server *WSServer) Start() {
 		maxConnNum:      server.MaxConnNum,
 		pendingWriteNum: server.PendingWriteNum,
 		maxMsgLen:       server.MaxMsgLen,
+		readIdle:        server.ReadIdleTimeout,
+		writeIdle:       server.WriteIdleTimeout,
+		compress:        server.CompressThreshold,
+		realIPHeader:    server.RealIPHeader,
 		newAgent:        server.NewAgent,
 		conns:           make(WebsocketConnSet),
 		upgrader: websocket.Upgrader{
-			HandshakeTimeout: server.HTTPTimeout,
-			CheckOrigin:      func(_ *http.Request) bool { return true },
+			HandshakeTimeout:  server.HTTPTimeout,
+			CheckOrigin:       func(_ *http.Request) bool { return true },
+			EnableCompression: server.CompressThreshold > 0,
 		},
 	}
 
@@ -140,6 +180,11 @@ func (server *WSServer) Start() {
 	go httpServer.Serve(ln)
 }
 
+// stops accepting new connections, the accepted ones are kept
+func (server *WSServer) CloseListener() {
+	server.ln.Close()
+}
+
 func (server *WSServer) Close() {
 	server.ln.Close()
 
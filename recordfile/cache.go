@@ -0,0 +1,208 @@
+package recordfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/name5566/leaf/log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// bump when the layout of the cache files changes
+const cacheVersion = 3
+
+// a cache file holds a cacheHeader followed by the number of records and
+// the records, in the binary encoding of codec.go, a cached record equals
+// a parsed one. The cache is used only if the hash of the source file and
+// the signature of the record type and the read options are unchanged, it
+// is rebuilt otherwise
+type cacheHeader struct {
+	Version   int
+	Hash      []byte
+	Signature string
+}
+
+// the cache file of name, keyed by its absolute path so tables sharing a
+// base name in different directories do not collide
+func (rf *RecordFile) cacheName(name string) string {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		abs = name
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(rf.CacheDir,
+		filepath.Base(name)+"."+hex.EncodeToString(sum[:8])+".cache")
+}
+
+func (rf *RecordFile) signature() string {
+	reader := rf.Reader
+	if reader == nil {
+		reader = CSVReader
+	}
+	comma, comment := rf.Comma, rf.Comment
+	if comma == 0 {
+		comma = Comma
+	}
+	if comment == 0 {
+		comment = Comment
+	}
+	headerRows := rf.HeaderRows
+	if headerRows <= 0 {
+		headerRows = 1
+	}
+	return fmt.Sprintf("%v|%#v|%q|%q|%v|%v", typeSignature(rf.typeRecord, nil),
+		reader, comma, comment, rf.ByHeader, headerRows)
+}
+
+// the layout of t, field names and tags included
+func typeSignature(t reflect.Type, visiting map[reflect.Type]bool) string {
+	switch t.Kind() {
+	case reflect.Struct:
+		if visiting[t] {
+			return t.String()
+		}
+		if visiting == nil {
+			visiting = make(map[reflect.Type]bool)
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+
+		fields := make([]string, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			fields[i] = fmt.Sprintf("%v %v %q", f.Name, typeSignature(f.Type, visiting), f.Tag)
+		}
+		return "struct{" + strings.Join(fields, "; ") + "}"
+	case reflect.Array:
+		return fmt.Sprintf("[%v]%v", t.Len(), typeSignature(t.Elem(), visiting))
+	case reflect.Slice:
+		return "[]" + typeSignature(t.Elem(), visiting)
+	case reflect.Map:
+		return fmt.Sprintf("map[%v]%v", typeSignature(t.Key(), visiting), typeSignature(t.Elem(), visiting))
+	case reflect.Ptr:
+		return "*" + typeSignature(t.Elem(), visiting)
+	default:
+		return t.Kind().String()
+	}
+}
+
+func (rf *RecordFile) readCached(name string, reader Reader) ([]interface{}, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	header := cacheHeader{
+		Version:   cacheVersion,
+		Hash:      sum[:],
+		Signature: rf.signature(),
+	}
+
+	cacheName := rf.cacheName(name)
+	records, err := rf.loadCache(cacheName, &header)
+	if err == nil {
+		return records, nil
+	}
+	if !os.IsNotExist(err) {
+		log.Debug("record file %v: rebuild cache: %v", name, err)
+	}
+
+	records, err = reader.ReadRecords(rf, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// the records are fine even if the cache could not be saved
+	err = rf.saveCache(cacheName, &header, records)
+	if err != nil {
+		log.Error("record file %v: save cache error: %v", name, err)
+	}
+	return records, nil
+}
+
+func (rf *RecordFile) loadCache(cacheName string, want *cacheHeader) ([]interface{}, error) {
+	data, err := os.ReadFile(cacheName)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decoder{data: data}
+	version := d.uvarint()
+	if version != uint64(want.Version) {
+		return nil, fmt.Errorf("version mismatch: %v (cache) %v (want)",
+			version, want.Version)
+	}
+	if !bytes.Equal(d.bytes(int(d.uvarint())), want.Hash) {
+		return nil, fmt.Errorf("source file changed")
+	}
+	if string(d.bytes(int(d.uvarint()))) != want.Signature {
+		return nil, fmt.Errorf("record type or options changed")
+	}
+
+	c, err := codecOf(rf.typeRecord)
+	if err != nil {
+		return nil, err
+	}
+	n := d.length(c.empty)
+	if n < 0 {
+		return nil, errTruncated
+	}
+	records := make([]interface{}, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		value := reflect.New(rf.typeRecord)
+		c.decode(d, value.Elem())
+		records[i] = value.Interface()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if d.off != len(data) {
+		return nil, fmt.Errorf("trailing data")
+	}
+	return records, nil
+}
+
+// written to a temporary file first, a reader never sees a partial cache
+func (rf *RecordFile) saveCache(cacheName string, header *cacheHeader, records []interface{}) error {
+	c, err := codecOf(rf.typeRecord)
+	if err != nil {
+		return err
+	}
+
+	b := binary.AppendUvarint(nil, uint64(header.Version))
+	b = binary.AppendUvarint(b, uint64(len(header.Hash)))
+	b = append(b, header.Hash...)
+	b = binary.AppendUvarint(b, uint64(len(header.Signature)))
+	b = append(b, header.Signature...)
+	b = binary.AppendUvarint(b, uint64(len(records))+1)
+	for _, r := range records {
+		b = c.encode(b, reflect.ValueOf(r).Elem())
+	}
+
+	err = os.MkdirAll(rf.CacheDir, 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(rf.CacheDir, filepath.Base(cacheName)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	err = os.Rename(f.Name(), cacheName)
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package recordfile_test
+
+import (
+	"fmt"
+	"github.com/name5566/leaf/recordfile"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	type Record struct {
+		ID     int
+		Ratio  float64
+		Name   string
+		Empty  []int
+		Nil    []int `rf:"optional"`
+		Arr    [2]int
+		M      map[string]int
+		EmptyM map[string]int
+		St     struct {
+			Tags []string
+		}
+		Items    []struct{ N *int }
+		Bytes    []byte
+		Small    float32
+		_Skipped int
+	}
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "record.txt")
+	data := "ID\tRatio\tName\tEmpty\tArr\tM\tEmptyM\tSt\tItems\tBytes\tSmall\n" +
+		"1\t0.1\tsword\t[]\t[1, 2]\t\"{\"\"a\"\": 1}\"\t{}\t\"{\"\"Tags\"\": []}\"\t\"[{\"\"N\"\": 1}, {}]\"\t\"\"\"AQI=\"\"\"\t0.5\n" +
+		"2\t1e300\t\t[3]\t[0, 0]\t{}\t{}\t{}\t[]\t\"\"\"\"\"\"\t-1\n"
+	if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(cacheDir string) []interface{} {
+		rf, err := recordfile.New(Record{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rf.ByHeader = true
+		rf.CacheDir = cacheDir
+		if err := rf.Read(name); err != nil {
+			t.Fatal(err)
+		}
+		records := make([]interface{}, rf.NumRecord())
+		for i := range records {
+			records[i] = rf.Record(i)
+		}
+		return records
+	}
+
+	parsed := read("")
+	cacheDir := filepath.Join(dir, "cache")
+	read(cacheDir)
+	if files, _ := os.ReadDir(cacheDir); len(files) != 1 {
+		t.Fatalf("%v cache files", len(files))
+	}
+	cached := read(cacheDir)
+
+	for i := range parsed {
+		if !reflect.DeepEqual(parsed[i], cached[i]) {
+			t.Fatalf("record %v: %+v (cached) %+v (parsed)", i, cached[i], parsed[i])
+		}
+	}
+	r := cached[0].(*Record)
+	if r.Empty == nil || r.Nil != nil || r.EmptyM == nil || r.St.Tags == nil ||
+		r.Items[0].N == nil || r.Items[1].N != nil || cached[1].(*Record).Bytes == nil {
+		t.Fatalf("nil and empty values mixed up: %+v", r)
+	}
+
+	// a truncated cache is rebuilt
+	files, _ := os.ReadDir(cacheDir)
+	cacheName := filepath.Join(cacheDir, files[0].Name())
+	b, _ := os.ReadFile(cacheName)
+	os.WriteFile(cacheName, b[:len(b)-3], 0644)
+	cached = read(cacheDir)
+	if !reflect.DeepEqual(parsed, cached) {
+		t.Fatal("truncated cache used")
+	}
+	if rebuilt, _ := os.ReadFile(cacheName); len(rebuilt) != len(b) {
+		t.Fatal("cache not rebuilt")
+	}
+}
+
+// loading the cache beats parsing the cells
+func BenchmarkRead(b *testing.B) {
+	type Record struct {
+		ID    int `rf:"index=byID"`
+		Name  string
+		Ratio float64
+		Stack []int
+		Attrs map[string]int
+		Drops []struct {
+			ItemID int
+			Weight float32
+		}
+	}
+
+	dir := b.TempDir()
+	name := filepath.Join(dir, "record.txt")
+	var data strings.Builder
+	data.WriteString("ID\tName\tRatio\tStack\tAttrs\tDrops\n")
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&data, "%v\titem %v\t%v\t[1, %v, 99]\t\"{\"\"hp\"\": %v, \"\"mp\"\": 5}\"\t\"[{\"\"ItemID\"\": %v, \"\"Weight\"\": 0.5}]\"\n",
+			i, i, float64(i)/3, i, i, i)
+	}
+	if err := os.WriteFile(name, []byte(data.String()), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	read := func(b *testing.B, cacheDir string) {
+		for i := 0; i < b.N; i++ {
+			rf, err := recordfile.New(Record{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			rf.ByHeader = true
+			rf.CacheDir = cacheDir
+			if err := rf.Read(name); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("parse", func(b *testing.B) {
+		read(b, "")
+	})
+	b.Run("cache", func(b *testing.B) {
+		cacheDir := filepath.Join(dir, "cache")
+		read(b, cacheDir)
+	})
+}
@@ -0,0 +1,316 @@
+package recordfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// the binary encoding of the cached records, the codec of a type is built
+// once. Integers are varints, floats are little endian, strings and []byte
+// are length prefixed. A slice, a map or a pointer starts with 0 if nil,
+// with its length + 1 otherwise, so nil and empty values are kept apart.
+// The fields of a struct are those set by a parse, the exported ones and
+// the embedded structs
+type codec struct {
+	encode func(b []byte, v reflect.Value) []byte
+	decode func(d *decoder, v reflect.Value)
+	// always encoded as 0 bytes
+	empty bool
+}
+
+var errTruncated = errors.New("truncated cache")
+
+type decoder struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	// the next reads fail too
+	d.off = len(d.data)
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data[d.off:])
+	if n <= 0 {
+		d.fail(errTruncated)
+		return 0
+	}
+	d.off += n
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.data[d.off:])
+	if n <= 0 {
+		d.fail(errTruncated)
+		return 0
+	}
+	d.off += n
+	return v
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if n < 0 || n > len(d.data)-d.off {
+		d.fail(errTruncated)
+		return nil
+	}
+	b := d.data[d.off : d.off+n]
+	d.off += n
+	return b
+}
+
+// the length + 1 of a slice or map, -1 for nil, at most one element per
+// remaining byte unless the elements are empty
+func (d *decoder) length(elemEmpty bool) int {
+	n := d.uvarint()
+	if n == 0 {
+		return -1
+	}
+	n--
+	if !elemEmpty && n > uint64(len(d.data)-d.off) || n > math.MaxInt32 {
+		d.fail(errTruncated)
+		return -1
+	}
+	return int(n)
+}
+
+var codecs sync.Map // reflect.Type -> *codec
+
+func codecOf(t reflect.Type) (*codec, error) {
+	if c, ok := codecs.Load(t); ok {
+		return c.(*codec), nil
+	}
+	c, err := buildCodec(t, make(map[reflect.Type]*codec))
+	if err != nil {
+		return nil, err
+	}
+	codecs.Store(t, c)
+	return c, nil
+}
+
+// building holds the codecs of the types being built, for recursive types
+func buildCodec(t reflect.Type, building map[reflect.Type]*codec) (*codec, error) {
+	if c, ok := building[t]; ok {
+		return c, nil
+	}
+	c := new(codec)
+	building[t] = c
+
+	switch t.Kind() {
+	case reflect.Bool:
+		c.encode = func(b []byte, v reflect.Value) []byte {
+			if v.Bool() {
+				return append(b, 1)
+			}
+			return append(b, 0)
+		}
+		c.decode = func(d *decoder, v reflect.Value) {
+			if b := d.bytes(1); b != nil {
+				v.SetBool(b[0] != 0)
+			}
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		c.encode = func(b []byte, v reflect.Value) []byte {
+			return binary.AppendVarint(b, v.Int())
+		}
+		c.decode = func(d *decoder, v reflect.Value) {
+			v.SetInt(d.varint())
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		c.encode = func(b []byte, v reflect.Value) []byte {
+			return binary.AppendUvarint(b, v.Uint())
+		}
+		c.decode = func(d *decoder, v reflect.Value) {
+			v.SetUint(d.uvarint())
+		}
+	case reflect.Float32:
+		c.encode = func(b []byte, v reflect.Value) []byte {
+			return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(v.Float())))
+		}
+		c.decode = func(d *decoder, v reflect.Value) {
+			if b := d.bytes(4); b != nil {
+				v.SetFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))))
+			}
+		}
+	case reflect.Float64:
+		c.encode = func(b []byte, v reflect.Value) []byte {
+			return binary.LittleEndian.AppendUint64(b, math.Float64bits(v.Float()))
+		}
+		c.decode = func(d *decoder, v reflect.Value) {
+			if b := d.bytes(8); b != nil {
+				v.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+			}
+		}
+	case reflect.String:
+		c.encode = func(b []byte, v reflect.Value) []byte {
+			b = binary.AppendUvarint(b, uint64(v.Len()))
+			return append(b, v.String()...)
+		}
+		c.decode = func(d *decoder, v reflect.Value) {
+			v.SetString(string(d.bytes(int(d.uvarint()))))
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			c.encode = func(b []byte, v reflect.Value) []byte {
+				if v.IsNil() {
+					return append(b, 0)
+				}
+				b = binary.AppendUvarint(b, uint64(v.Len())+1)
+				return append(b, v.Bytes()...)
+			}
+			c.decode = func(d *decoder, v reflect.Value) {
+				n := d.length(false)
+				if n < 0 {
+					v.Set(reflect.Zero(t))
+					return
+				}
+				s := reflect.MakeSlice(t, n, n)
+				copy(s.Bytes(), d.bytes(n))
+				v.Set(s)
+			}
+			break
+		}
+		elem, err := buildCodec(t.Elem(), building)
+		if err != nil {
+			return nil, err
+		}
+		c.encode = func(b []byte, v reflect.Value) []byte {
+			if v.IsNil() {
+				return append(b, 0)
+			}
+			b = binary.AppendUvarint(b, uint64(v.Len())+1)
+			for i := 0; i < v.Len(); i++ {
+				b = elem.encode(b, v.Index(i))
+			}
+			return b
+		}
+		c.decode = func(d *decoder, v reflect.Value) {
+			n := d.length(elem.empty)
+			if n < 0 {
+				v.Set(reflect.Zero(t))
+				return
+			}
+			s := reflect.MakeSlice(t, n, n)
+			for i := 0; i < n; i++ {
+				elem.decode(d, s.Index(i))
+			}
+			v.Set(s)
+		}
+	case reflect.Array:
+		elem, err := buildCodec(t.Elem(), building)
+		if err != nil {
+			return nil, err
+		}
+		c.empty = t.Len() == 0 || elem.empty
+		c.encode = func(b []byte, v reflect.Value) []byte {
+			for i := 0; i < v.Len(); i++ {
+				b = elem.encode(b, v.Index(i))
+			}
+			return b
+		}
+		c.decode = func(d *decoder, v reflect.Value) {
+			for i := 0; i < v.Len(); i++ {
+				elem.decode(d, v.Index(i))
+			}
+		}
+	case reflect.Map:
+		key, err := buildCodec(t.Key(), building)
+		if err != nil {
+			return nil, err
+		}
+		elem, err := buildCodec(t.Elem(), building)
+		if err != nil {
+			return nil, err
+		}
+		c.encode = func(b []byte, v reflect.Value) []byte {
+			if v.IsNil() {
+				return append(b, 0)
+			}
+			b = binary.AppendUvarint(b, uint64(v.Len())+1)
+			iter := v.MapRange()
+			for iter.Next() {
+				b = key.encode(b, iter.Key())
+				b = elem.encode(b, iter.Value())
+			}
+			return b
+		}
+		c.decode = func(d *decoder, v reflect.Value) {
+			n := d.length(key.empty && elem.empty)
+			if n < 0 {
+				v.Set(reflect.Zero(t))
+				return
+			}
+			m := reflect.MakeMapWithSize(t, n)
+			k := reflect.New(t.Key()).Elem()
+			e := reflect.New(t.Elem()).Elem()
+			for i := 0; i < n && d.err == nil; i++ {
+				key.decode(d, k)
+				elem.decode(d, e)
+				m.SetMapIndex(k, e)
+			}
+			v.Set(m)
+		}
+	case reflect.Ptr:
+		elem, err := buildCodec(t.Elem(), building)
+		if err != nil {
+			return nil, err
+		}
+		c.encode = func(b []byte, v reflect.Value) []byte {
+			if v.IsNil() {
+				return append(b, 0)
+			}
+			return elem.encode(append(b, 1), v.Elem())
+		}
+		c.decode = func(d *decoder, v reflect.Value) {
+			if d.uvarint() == 0 {
+				v.Set(reflect.Zero(t))
+				return
+			}
+			p := reflect.New(t.Elem())
+			elem.decode(d, p.Elem())
+			v.Set(p)
+		}
+	case reflect.Struct:
+		var fields []int
+		var codecs []*codec
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" && !(f.Anonymous && f.Type.Kind() == reflect.Struct) {
+				continue
+			}
+			fc, err := buildCodec(f.Type, building)
+			if err != nil {
+				return nil, fmt.Errorf("field %v: %v", f.Name, err)
+			}
+			fields = append(fields, i)
+			codecs = append(codecs, fc)
+		}
+		c.empty = true
+		for _, fc := range codecs {
+			c.empty = c.empty && fc.empty
+		}
+		c.encode = func(b []byte, v reflect.Value) []byte {
+			for i, fc := range codecs {
+				b = fc.encode(b, v.Field(fields[i]))
+			}
+			return b
+		}
+		c.decode = func(d *decoder, v reflect.Value) {
+			for i, fc := range codecs {
+				fc.decode(d, v.Field(fields[i]))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("type %v not supported", t)
+	}
+	return c, nil
+}
@@ -1,8 +1,11 @@
 package recordfile_test
 
 import (
+	"errors"
 	"fmt"
 	"github.com/name5566/leaf/recordfile"
+	"os"
+	"path/filepath"
 )
 
 func Example() {
@@ -65,3 +68,328 @@ func Example() {
 	// name5566
 	// 6
 }
+
+func ExampleReloader() {
+	type Record struct {
+		IndexInt int
+		IndexStr string
+		_Number  int32
+		Str      string
+		Arr1     [2]int
+		Arr2     [3][2]int
+		Arr3     []int
+		St       struct {
+			Name string
+			Num  int
+		}
+		M map[string]int
+	}
+
+	rf, err := recordfile.New(Record{})
+	if err != nil {
+		return
+	}
+
+	r := recordfile.NewReloader()
+	r.Add(rf, "test.txt")
+	r.Validate = func(files map[string]*recordfile.RecordFile) error {
+		if files["test.txt"].NumRecord() == 0 {
+			return errors.New("test.txt is empty")
+		}
+		return nil
+	}
+
+	err = r.Reload()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// the files of one reload, not replaced while iterating
+	test := r.Snapshot()["test.txt"]
+	for i := 0; i < test.NumRecord(); i++ {
+		fmt.Println(test.Record(i).(*Record).IndexInt)
+	}
+
+	// Output:
+	// 1
+	// 2
+	// 3
+}
+
+func ExampleGet() {
+	type Item struct {
+		ID    int   `rf:"index=byID"`
+		Type  int   `rf:"multi=byType"`
+		Stage int32 `rf:"index=byStage"`
+		Level int32 `rf:"index=byStage"`
+		Name  string
+	}
+
+	rf, err := recordfile.New(Item{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	err = rf.Read("test_item.txt")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	item, _ := recordfile.Get[Item](rf, "byID", 3)
+	fmt.Println(item.Name)
+	items, _ := recordfile.GetAll[Item](rf, "byType", 1)
+	for _, item := range items {
+		fmt.Println(item.Name)
+	}
+	item, _ = recordfile.Get[Item](rf, "byStage", 1, 2)
+	fmt.Println(item.Name)
+	item, _ = recordfile.Get[Item](rf, "byStage", 2, 2)
+	fmt.Println(item == nil)
+
+	// the keys are not converted with a loss
+	_, err = recordfile.Get[Item](rf, "byID", 2.9)
+	fmt.Println(err)
+	_, err = recordfile.Get[Item](rf, "byID", "2")
+	fmt.Println(err)
+	_, err = recordfile.Get[Item](rf, "byName", 2)
+	fmt.Println(err)
+	_, err = recordfile.Get[struct{ ID int }](rf, "byID", 2)
+	fmt.Println(err)
+
+	// Output:
+	// potion
+	// sword
+	// axe
+	// axe
+	// true
+	// index byID: invalid key 2.9 (float64) for int
+	// index byID: invalid key 2 (string) for int
+	// index byName not found
+	// record type mismatch: struct { ID int } (want recordfile_test.Item)
+}
+
+func ExampleLoader() {
+	type Item struct {
+		ID    int `rf:"index=byID"`
+		Type  int
+		Stage int32
+		Level int32
+		Name  string
+	}
+	type Drop struct {
+		ID     int
+		ItemID int   `ref:"Item.ID"`
+		Extra  []int `ref:"Item.ID,omitempty"`
+	}
+
+	items, err := recordfile.New(Item{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	drops, err := recordfile.New(Drop{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	drops.ByHeader = true
+
+	l := recordfile.NewLoader()
+	l.Add("Item", items, "test_item.txt")
+	l.Add("Drop", drops, "test_drop.txt")
+	fmt.Println(l.Load())
+	fmt.Println(drops.NumRecord())
+
+	// Output:
+	// reload error: test_drop.txt (row=2, col=ItemID): ItemID 4 not found in Item.ID
+	// test_drop.txt (row=2, col=Extra): Extra 5 not found in Item.ID
+	// 0
+}
+
+func ExampleReader() {
+	type Item struct {
+		ID    int `rf:"index=byID"`
+		Type  int
+		Stage int32
+		Level int32
+		Name  string
+	}
+
+	files := []struct {
+		name   string
+		reader recordfile.Reader
+	}{
+		{"test_item.txt", recordfile.CSVReader},
+		{"test_item.json", recordfile.JSONReader},
+		{"test_item.jsonl", recordfile.JSONLinesReader},
+		{"test_item.xlsx", recordfile.XLSXReader{Sheet: "Item"}},
+	}
+
+	for _, f := range files {
+		rf, err := recordfile.New(Item{})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		rf.Reader = f.reader
+
+		err = rf.Read(f.name)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		item, _ := recordfile.Get[Item](rf, "byID", 2)
+		fmt.Println(rf.NumRecord(), item.Name)
+	}
+
+	// Output:
+	// 3 axe
+	// 3 axe
+	// 3 axe
+	// 3 axe
+}
+
+func ExampleRecordFile_ByHeader() {
+	type Item struct {
+		ID    int `rf:"col=ItemID,index=byID"`
+		Type  int
+		Stage int32 `rf:"default=1"`
+		Level int32
+		Name  string
+		Price int `rf:"optional"`
+	}
+
+	rf, err := recordfile.New(Item{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	rf.ByHeader = true
+
+	err = rf.Read("test_item_ext.txt")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for i := 0; i < rf.NumRecord(); i++ {
+		item, _ := recordfile.RecordOf[Item](rf, i)
+		fmt.Println(*item)
+	}
+
+	type Drop struct {
+		ID     int
+		ItemID int
+		Extra  []int
+	}
+	rf, err = recordfile.New(Drop{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	rf.ByHeader = true
+
+	err = rf.Read("test_item_ext.txt")
+	fmt.Println(err)
+
+	// Output:
+	// {1 1 1 1 sword 0}
+	// {2 1 1 2 axe 0}
+	// {3 2 1 1 potion 0}
+	// header error: missing columns ID, Extra
+}
+
+func ExampleRecordFile_ParseRows() {
+	type Item struct {
+		ID    int
+		Stage int32 `rf:"default=1"`
+		Price int   `rf:"optional"`
+	}
+
+	rf, err := recordfile.New(Item{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	rf.ByHeader = true
+
+	// the empty cells of optional columns are missing values
+	records, err := rf.ParseRows([][]string{
+		{"ID", "Stage", "Price"},
+		{"1", "", ""},
+		{"2", "3", "10"},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, r := range records {
+		fmt.Println(*r.(*Item))
+	}
+
+	// but not those of required columns
+	_, err = rf.ParseRows([][]string{
+		{"ID", "Stage", "Price"},
+		{"", "3", "10"},
+	})
+	fmt.Println(err)
+
+	// Output:
+	// {1 1 0}
+	// {2 3 10}
+	// parse field (row=1, col=ID) error: strconv.ParseInt: parsing "": invalid syntax
+}
+
+func ExampleRecordFile_CacheDir() {
+	type Item struct {
+		ID    int `rf:"index=byID"`
+		Type  int
+		Stage int32
+		Level int32
+		Name  string
+	}
+
+	dir, err := os.MkdirTemp("", "recordfile")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "item.txt")
+	data := "ID\tType\tStage\tLevel\tName\n1\t1\t1\t1\tsword\n"
+	os.WriteFile(name, []byte(data), 0644)
+
+	read := func() {
+		rf, err := recordfile.New(Item{})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		rf.CacheDir = filepath.Join(dir, "cache")
+
+		err = rf.Read(name)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		item, _ := recordfile.Get[Item](rf, "byID", 1)
+		fmt.Println(rf.NumRecord(), item.Name)
+	}
+
+	// parsed and cached
+	read()
+	// from the cache
+	read()
+
+	// the cache is stale and rebuilt
+	os.WriteFile(name, []byte(data+"2\t1\t1\t2\taxe\n"), 0644)
+	read()
+
+	// Output:
+	// 1 sword
+	// 1 sword
+	// 2 sword
+}
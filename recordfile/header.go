@@ -0,0 +1,105 @@
+package recordfile
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// with RecordFile.ByHeader set, columns are mapped to the fields by the
+// header row:
+//
+//	ID    int                             column "ID"
+//	Name  string `rf:"col=ItemName"`       column "ItemName"
+//	Price int    `rf:"optional"`           zero value if the column is missing
+//	Stack []int  `rf:"default=[1, 99]"`    parsed value if the column is missing
+//
+// empty cells of optional columns are treated as missing, an empty cell of
+// a required column is a parse error, unknown columns are ignored
+type colDef struct {
+	name     string
+	optional bool
+	// nil if the field has no default, parsed for every record so that
+	// the records do not share the slices and maps
+	defValue *string
+}
+
+func parseColDefs(typeRecord reflect.Type) ([]*colDef, error) {
+	defs := make([]*colDef, typeRecord.NumField())
+	names := make(map[string]string)
+
+	for i := 0; i < typeRecord.NumField(); i++ {
+		f := typeRecord.Field(i)
+		opts := tagOptions(f)
+
+		def := &colDef{name: f.Name}
+		if cols := opts["col"]; len(cols) > 0 {
+			if cols[0] == "" {
+				return nil, fmt.Errorf("field %v: col name required", f.Name)
+			}
+			def.name = cols[0]
+		}
+		if other, ok := names[def.name]; ok {
+			return nil, fmt.Errorf("field %v: column %v already mapped to %v",
+				f.Name, def.name, other)
+		}
+		names[def.name] = f.Name
+
+		// unexported fields are never set
+		if _, ok := opts["optional"]; ok || f.PkgPath != "" {
+			def.optional = true
+		}
+		if values := opts["default"]; len(values) > 0 {
+			v := reflect.New(f.Type).Elem()
+			err := parseField(v, values[0])
+			if err != nil {
+				return nil, fmt.Errorf("field %v: invalid default %v: %v",
+					f.Name, values[0], err)
+			}
+			def.optional = true
+			def.defValue = &values[0]
+		}
+
+		defs[i] = def
+	}
+
+	return defs, nil
+}
+
+// the column of each field, -1 if missing
+func (rf *RecordFile) mapHeader(header []string) ([]int, error) {
+	cols := make(map[string]int, len(header))
+	dup := make(map[string]bool)
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		if _, ok := cols[name]; ok {
+			dup[name] = true
+		}
+		cols[name] = i
+	}
+
+	colOf := make([]int, len(rf.colDefs))
+	var missing []string
+	for i, def := range rf.colDefs {
+		col, ok := cols[def.name]
+		if dup[def.name] {
+			return nil, fmt.Errorf("header error: duplicate column %v", def.name)
+		}
+		if !ok {
+			col = -1
+			if !def.optional {
+				missing = append(missing, def.name)
+			}
+		}
+		colOf[i] = col
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("header error: missing columns %v",
+			strings.Join(missing, ", "))
+	}
+
+	return colOf, nil
+}
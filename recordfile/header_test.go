@@ -0,0 +1,38 @@
+package recordfile_test
+
+import (
+	"github.com/name5566/leaf/recordfile"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// the records do not share the slices and maps of the defaults
+func TestDefaultNotShared(t *testing.T) {
+	type Record struct {
+		ID    int
+		Stack []int          `rf:"default=[1, 99]"`
+		Attrs map[string]int `rf:"default={\"hp\": 10}"`
+	}
+
+	name := filepath.Join(t.TempDir(), "record.txt")
+	if err := os.WriteFile(name, []byte("ID\n1\n2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rf, err := recordfile.New(Record{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf.ByHeader = true
+	if err := rf.Read(name); err != nil {
+		t.Fatal(err)
+	}
+
+	r1 := rf.Record(0).(*Record)
+	r1.Stack[1] = 0
+	r1.Attrs["hp"] = 0
+	r2 := rf.Record(1).(*Record)
+	if r2.Stack[1] != 99 || r2.Attrs["hp"] != 10 {
+		t.Fatalf("default modified: %v, %v", r2.Stack, r2.Attrs)
+	}
+}
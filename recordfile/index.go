@@ -0,0 +1,257 @@
+package recordfile
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// named indexes are declared by the rf tag:
+//
+//	ID    int `rf:"index=byID"`     unique
+//	Type  int `rf:"multi=byType"`   non-unique
+//	Stage int `rf:"index=byStage"`  fields sharing a name
+//	Level int `rf:"index=byStage"`  form a composite key in field order
+type indexDef struct {
+	name    string
+	unique  bool
+	fields  []int
+	keyType reflect.Type
+}
+
+type namedIndex map[interface{}][]interface{}
+
+var typeInterface = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// rf tag options are comma separated key=value pairs, default takes the
+// rest of the tag so it must come last
+func tagOptions(f reflect.StructField) map[string][]string {
+	opts := make(map[string][]string)
+	tag := f.Tag.Get("rf")
+	if tag == "" {
+		return opts
+	}
+	for tag != "" {
+		var opt string
+		if strings.HasPrefix(strings.TrimSpace(tag), "default=") {
+			opt, tag = strings.TrimSpace(tag), ""
+		} else if i := strings.Index(tag, ","); i >= 0 {
+			opt, tag = tag[:i], tag[i+1:]
+		} else {
+			opt, tag = tag, ""
+		}
+
+		kv := strings.SplitN(strings.TrimSpace(opt), "=", 2)
+		if len(kv) == 2 {
+			opts[kv[0]] = append(opts[kv[0]], kv[1])
+		} else {
+			opts[kv[0]] = append(opts[kv[0]], "")
+		}
+	}
+	return opts
+}
+
+func parseIndexDefs(typeRecord reflect.Type) ([]*indexDef, error) {
+	var defs []*indexDef
+	byName := make(map[string]*indexDef)
+
+	for i := 0; i < typeRecord.NumField(); i++ {
+		f := typeRecord.Field(i)
+		opts := tagOptions(f)
+
+		for _, key := range []string{"index", "multi"} {
+			for _, name := range opts[key] {
+				if name == "" {
+					return nil, fmt.Errorf("field %v: %v name required", f.Name, key)
+				}
+				switch f.Type.Kind() {
+				case reflect.Struct, reflect.Slice, reflect.Map:
+					return nil, fmt.Errorf("could not index %s field %v %v",
+						f.Type.Kind(), i, f.Name)
+				}
+
+				def := byName[name]
+				if def == nil {
+					def = &indexDef{name: name, unique: key == "index"}
+					byName[name] = def
+					defs = append(defs, def)
+				} else if def.unique != (key == "index") {
+					return nil, fmt.Errorf("index %v: mixed index and multi", name)
+				}
+				def.fields = append(def.fields, i)
+			}
+		}
+	}
+
+	for _, def := range defs {
+		if len(def.fields) == 1 {
+			def.keyType = typeRecord.Field(def.fields[0]).Type
+		} else {
+			def.keyType = reflect.ArrayOf(len(def.fields), typeInterface)
+		}
+	}
+	return defs, nil
+}
+
+func (def *indexDef) recordKey(record reflect.Value) interface{} {
+	if len(def.fields) == 1 {
+		return record.Field(def.fields[0]).Interface()
+	}
+
+	key := reflect.New(def.keyType).Elem()
+	for i, n := range def.fields {
+		key.Index(i).Set(record.Field(n))
+	}
+	return key.Interface()
+}
+
+// keys are converted to the field types, so untyped constants can be used,
+// only between types of the same kind and without loss
+func (def *indexDef) lookupKey(typeRecord reflect.Type, keys []interface{}) (interface{}, error) {
+	if len(keys) != len(def.fields) {
+		return nil, fmt.Errorf("index %v: %v keys required", def.name, len(def.fields))
+	}
+
+	values := make([]reflect.Value, len(keys))
+	for i, k := range keys {
+		t := typeRecord.Field(def.fields[i]).Type
+		v, ok := convertKey(reflect.ValueOf(k), t)
+		if !ok {
+			return nil, fmt.Errorf("index %v: invalid key %v (%T) for %v", def.name, k, k, t)
+		}
+		values[i] = v
+	}
+
+	if len(values) == 1 {
+		return values[0].Interface(), nil
+	}
+	key := reflect.New(def.keyType).Elem()
+	for i, v := range values {
+		key.Index(i).Set(v)
+	}
+	return key.Interface(), nil
+}
+
+func isInt(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUint(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uintptr
+}
+
+func isFloat(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+// integers convert to integers and floats to floats if the value fits,
+// the other kinds only to themselves
+func convertKey(v reflect.Value, t reflect.Type) (reflect.Value, bool) {
+	if !v.IsValid() {
+		return v, false
+	}
+
+	z := reflect.Zero(t)
+	from, to := v.Kind(), t.Kind()
+	switch {
+	case isInt(from) && isInt(to):
+		if z.OverflowInt(v.Int()) {
+			return v, false
+		}
+	case isInt(from) && isUint(to):
+		if v.Int() < 0 || z.OverflowUint(uint64(v.Int())) {
+			return v, false
+		}
+	case isUint(from) && isInt(to):
+		if v.Uint() > math.MaxInt64 || z.OverflowInt(int64(v.Uint())) {
+			return v, false
+		}
+	case isUint(from) && isUint(to):
+		if z.OverflowUint(v.Uint()) {
+			return v, false
+		}
+	case isFloat(from) && isFloat(to):
+		if to == reflect.Float32 && float64(float32(v.Float())) != v.Float() {
+			return v, false
+		}
+	case from == to && v.Type().ConvertibleTo(t):
+	default:
+		return v, false
+	}
+	return v.Convert(t), true
+}
+
+func (rf *RecordFile) indexDef(name string) *indexDef {
+	for _, def := range rf.indexDefs {
+		if def.name == name {
+			return def
+		}
+	}
+	return nil
+}
+
+// all the records matching keys, nil if none
+func (rf *RecordFile) LookupAll(index string, keys ...interface{}) ([]interface{}, error) {
+	def := rf.indexDef(index)
+	if def == nil {
+		return nil, fmt.Errorf("index %v not found", index)
+	}
+	key, err := def.lookupKey(rf.typeRecord, keys)
+	if err != nil {
+		return nil, err
+	}
+	return rf.load().named[index][key], nil
+}
+
+// the first record matching keys, nil if none
+func (rf *RecordFile) Lookup(index string, keys ...interface{}) (interface{}, error) {
+	records, err := rf.LookupAll(index, keys...)
+	if len(records) == 0 {
+		return nil, err
+	}
+	return records[0], nil
+}
+
+func checkType[T any](rf *RecordFile) error {
+	if reflect.TypeOf((*T)(nil)).Elem() != rf.typeRecord {
+		var t T
+		return fmt.Errorf("record type mismatch: %T (want %v)", t, rf.typeRecord)
+	}
+	return nil
+}
+
+// nil if no record matches keys
+func Get[T any](rf *RecordFile, index string, keys ...interface{}) (*T, error) {
+	if err := checkType[T](rf); err != nil {
+		return nil, err
+	}
+	r, err := rf.Lookup(index, keys...)
+	if r == nil {
+		return nil, err
+	}
+	return r.(*T), nil
+}
+
+func GetAll[T any](rf *RecordFile, index string, keys ...interface{}) ([]*T, error) {
+	if err := checkType[T](rf); err != nil {
+		return nil, err
+	}
+	records, err := rf.LookupAll(index, keys...)
+	if err != nil {
+		return nil, err
+	}
+	rs := make([]*T, len(records))
+	for i, r := range records {
+		rs[i] = r.(*T)
+	}
+	return rs, nil
+}
+
+// panics like Record if i is out of range
+func RecordOf[T any](rf *RecordFile, i int) (*T, error) {
+	if err := checkType[T](rf); err != nil {
+		return nil, err
+	}
+	return rf.Record(i).(*T), nil
+}
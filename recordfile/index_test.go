@@ -0,0 +1,59 @@
+package recordfile_test
+
+import (
+	"github.com/name5566/leaf/recordfile"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a duplicate is reported at the row of a parse error of the same line
+func TestDuplicateRow(t *testing.T) {
+	type Legacy struct {
+		ID   int "index"
+		Name string
+	}
+	type Named struct {
+		ID   int `rf:"index=byID"`
+		Name string
+	}
+
+	dir := t.TempDir()
+	read := func(st interface{}, byHeader bool, third string) error {
+		name := filepath.Join(dir, "record.txt")
+		data := "ID\tName\n" +
+			"int\tstring\n" +
+			"1\ta\n" +
+			third + "\tb\n"
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rf, err := recordfile.New(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rf.ByHeader = byHeader
+		rf.HeaderRows = 2
+		return rf.Read(name)
+	}
+
+	for _, c := range []struct {
+		st       interface{}
+		byHeader bool
+		dup      string
+	}{
+		{Legacy{}, false, "index error: duplicate at (row=3, col=0)"},
+		{Legacy{}, true, "index error: duplicate at (row=3, col=ID)"},
+		{Named{}, true, "index byID error: duplicate at (row=3)"},
+	} {
+		err := read(c.st, c.byHeader, "x")
+		if err == nil || !strings.Contains(err.Error(), "row=3") {
+			t.Fatalf("parse error: %v", err)
+		}
+		err = read(c.st, c.byHeader, "1")
+		if err == nil || !strings.Contains(err.Error(), c.dup) {
+			t.Fatalf("duplicate error: %v, want %v", err, c.dup)
+		}
+	}
+}
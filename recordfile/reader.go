@@ -0,0 +1,106 @@
+package recordfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// a Reader turns a file into records, see NewRecord and ParseRows
+type Reader interface {
+	ReadRecords(rf *RecordFile, name string) ([]interface{}, error)
+}
+
+var (
+	// delimiter-separated text, see RecordFile.Comma and RecordFile.Comment
+	CSVReader Reader = csvReader{}
+	// a JSON array of objects, keys are matched to the field names
+	JSONReader Reader = jsonReader{}
+	// one JSON object per line, blank lines are skipped
+	JSONLinesReader Reader = jsonLinesReader{}
+)
+
+type csvReader struct{}
+
+func (csvReader) ReadRecords(rf *RecordFile, name string) ([]interface{}, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if rf.Comma == 0 {
+		rf.Comma = Comma
+	}
+	if rf.Comment == 0 {
+		rf.Comment = Comment
+	}
+	reader := csv.NewReader(file)
+	reader.Comma = rf.Comma
+	reader.Comment = rf.Comment
+	lines, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	return rf.ParseRows(lines)
+}
+
+type jsonReader struct{}
+
+func (jsonReader) ReadRecords(rf *RecordFile, name string) ([]interface{}, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []json.RawMessage
+	err = json.Unmarshal(data, &objects)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]interface{}, len(objects))
+	for n, object := range objects {
+		records[n] = rf.NewRecord()
+		err = json.Unmarshal(object, records[n])
+		if err != nil {
+			return nil, fmt.Errorf("parse record (row=%v) error: %v", n+1, err)
+		}
+	}
+	return records, nil
+}
+
+type jsonLinesReader struct{}
+
+func (jsonLinesReader) ReadRecords(rf *RecordFile, name string) ([]interface{}, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []interface{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		record := rf.NewRecord()
+		err = json.Unmarshal(line, record)
+		if err != nil {
+			return nil, fmt.Errorf("parse record (line=%v) error: %v", n, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
@@ -1,13 +1,12 @@
 package recordfile
 
 import (
-	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"reflect"
 	"strconv"
+	"sync/atomic"
 )
 
 var Comma = '\t'
@@ -16,11 +15,30 @@ var Comment = '#'
 type Index map[interface{}]interface{}
 
 type RecordFile struct {
-	Comma      rune
-	Comment    rune
+	Comma   rune
+	Comment rune
+	// nil means CSVReader
+	Reader Reader
+	// map the columns to the fields by the header row instead of by position
+	ByHeader bool
+	// rows before the records, the first one is the header, 0 means 1
+	HeaderRows int
+	// cache the parsed records in CacheDir if not empty, the fields must
+	// not be interfaces, funcs or channels
+	CacheDir   string
 	typeRecord reflect.Type
-	records    []interface{}
-	indexes    []Index
+	colDefs    []*colDef
+	indexDefs  []*indexDef
+	refDefs    []*refDef
+	// *table, replaced as a whole by Read
+	table atomic.Value
+}
+
+type table struct {
+	file    string
+	records []interface{}
+	indexes []Index
+	named   map[string]namedIndex
 }
 
 func New(st interface{}) (*RecordFile, error) {
@@ -67,152 +85,301 @@ func New(st interface{}) (*RecordFile, error) {
 		}
 	}
 
+	colDefs, err := parseColDefs(typeRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	indexDefs, err := parseIndexDefs(typeRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	refDefs, err := parseRefDefs(typeRecord)
+	if err != nil {
+		return nil, err
+	}
+
 	rf := new(RecordFile)
 	rf.typeRecord = typeRecord
+	rf.colDefs = colDefs
+	rf.indexDefs = indexDefs
+	rf.refDefs = refDefs
+	rf.table.Store(new(table))
 
 	return rf, nil
 }
 
+// the records are replaced atomically, goroutine safe with the readers
 func (rf *RecordFile) Read(name string) error {
-	file, err := os.Open(name)
+	t, err := rf.read(name)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	if rf.Comma == 0 {
-		rf.Comma = Comma
+	rf.table.Store(t)
+	return nil
+}
+
+func (rf *RecordFile) load() *table {
+	return rf.table.Load().(*table)
+}
+
+// a RecordFile sharing the definition of rf and holding t
+func (rf *RecordFile) clone(t *table) *RecordFile {
+	c := &RecordFile{
+		Comma:      rf.Comma,
+		Comment:    rf.Comment,
+		Reader:     rf.Reader,
+		ByHeader:   rf.ByHeader,
+		HeaderRows: rf.HeaderRows,
+		CacheDir:   rf.CacheDir,
+		typeRecord: rf.typeRecord,
+		colDefs:    rf.colDefs,
+		indexDefs:  rf.indexDefs,
+		refDefs:    rf.refDefs,
 	}
-	if rf.Comment == 0 {
-		rf.Comment = Comment
+	c.table.Store(t)
+	return c
+}
+
+func (rf *RecordFile) read(name string) (*table, error) {
+	reader := rf.Reader
+	if reader == nil {
+		reader = CSVReader
+	}
+	var records []interface{}
+	var err error
+	if rf.CacheDir != "" {
+		records, err = rf.readCached(name, reader)
+	} else {
+		records, err = reader.ReadRecords(rf, name)
 	}
-	reader := csv.NewReader(file)
-	reader.Comma = rf.Comma
-	reader.Comment = rf.Comment
-	lines, err := reader.ReadAll()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	return rf.newTable(name, records)
+}
+
+func (rf *RecordFile) NewRecord() interface{} {
+	return reflect.New(rf.typeRecord).Interface()
+}
+
+// the first row is the header, the others after HeaderRows are mapped to
+// the fields by position, or by name if ByHeader is set
+func (rf *RecordFile) ParseRows(lines [][]string) ([]interface{}, error) {
 	typeRecord := rf.typeRecord
 
+	headerRows := rf.HeaderRows
+	if headerRows <= 0 {
+		headerRows = 1
+	}
+
 	// make records
-	records := make([]interface{}, len(lines)-1)
+	if len(lines) <= headerRows {
+		return nil, nil
+	}
+	records := make([]interface{}, len(lines)-headerRows)
 
-	// make indexes
-	indexes := []Index{}
-	for i := 0; i < typeRecord.NumField(); i++ {
-		tag := typeRecord.Field(i).Tag
-		if tag == "index" {
-			indexes = append(indexes, make(Index))
+	if rf.ByHeader {
+		colOf, err := rf.mapHeader(lines[0])
+		if err != nil {
+			return nil, err
+		}
+		for n := headerRows; n < len(lines); n++ {
+			records[n-headerRows], err = rf.parseRowByHeader(n, lines[n], len(lines[0]), colOf)
+			if err != nil {
+				return nil, err
+			}
 		}
+		return records, nil
 	}
 
-	for n := 1; n < len(lines); n++ {
+	for n := headerRows; n < len(lines); n++ {
 		value := reflect.New(typeRecord)
-		records[n-1] = value.Interface()
+		records[n-headerRows] = value.Interface()
 		record := value.Elem()
 
 		line := lines[n]
 		if len(line) != typeRecord.NumField() {
-			return fmt.Errorf("line %v, field count mismatch: %v (file) %v (st)",
+			return nil, fmt.Errorf("line %v, field count mismatch: %v (file) %v (st)",
 				n, len(line), typeRecord.NumField())
 		}
 
-		iIndex := 0
-
 		for i := 0; i < typeRecord.NumField(); i++ {
-			f := typeRecord.Field(i)
-
 			// records
-			strField := line[i]
 			field := record.Field(i)
 			if !field.CanSet() {
 				continue
 			}
 
-			var err error
-
-			kind := f.Type.Kind()
-			if kind == reflect.Bool {
-				var v bool
-				v, err = strconv.ParseBool(strField)
-				if err == nil {
-					field.SetBool(v)
-				}
-			} else if kind == reflect.Int ||
-				kind == reflect.Int8 ||
-				kind == reflect.Int16 ||
-				kind == reflect.Int32 ||
-				kind == reflect.Int64 {
-				var v int64
-				v, err = strconv.ParseInt(strField, 0, f.Type.Bits())
-				if err == nil {
-					field.SetInt(v)
-				}
-			} else if kind == reflect.Uint ||
-				kind == reflect.Uint8 ||
-				kind == reflect.Uint16 ||
-				kind == reflect.Uint32 ||
-				kind == reflect.Uint64 {
-				var v uint64
-				v, err = strconv.ParseUint(strField, 0, f.Type.Bits())
-				if err == nil {
-					field.SetUint(v)
-				}
-			} else if kind == reflect.Float32 ||
-				kind == reflect.Float64 {
-				var v float64
-				v, err = strconv.ParseFloat(strField, f.Type.Bits())
-				if err == nil {
-					field.SetFloat(v)
-				}
-			} else if kind == reflect.String {
-				field.SetString(strField)
-			} else if kind == reflect.Struct ||
-				kind == reflect.Array ||
-				kind == reflect.Slice ||
-				kind == reflect.Map {
-				err = json.Unmarshal([]byte(strField), field.Addr().Interface())
-			}
-
+			err := parseField(field, line[i])
 			if err != nil {
-				return fmt.Errorf("parse field (row=%v, col=%v) error: %v",
+				return nil, fmt.Errorf("parse field (row=%v, col=%v) error: %v",
 					n, i, err)
 			}
+		}
+	}
+
+	return records, nil
+}
+
+func (rf *RecordFile) parseRowByHeader(n int, line []string, numCol int, colOf []int) (interface{}, error) {
+	if len(line) != numCol {
+		return nil, fmt.Errorf("line %v, field count mismatch: %v (file) %v (header)",
+			n, len(line), numCol)
+	}
+
+	value := reflect.New(rf.typeRecord)
+	record := value.Elem()
+	for i, col := range colOf {
+		field := record.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+
+		// empty cells of optional columns are missing values
+		if col < 0 || line[col] == "" && rf.colDefs[i].optional {
+			// the default was checked by New
+			if v := rf.colDefs[i].defValue; v != nil {
+				parseField(field, *v)
+			}
+			continue
+		}
+
+		err := parseField(field, line[col])
+		if err != nil {
+			return nil, fmt.Errorf("parse field (row=%v, col=%v) error: %v",
+				n, rf.colDefs[i].name, err)
+		}
+	}
+
+	return value.Interface(), nil
+}
+
+func parseField(field reflect.Value, strField string) error {
+	var err error
+
+	kind := field.Kind()
+	if kind == reflect.Bool {
+		var v bool
+		v, err = strconv.ParseBool(strField)
+		if err == nil {
+			field.SetBool(v)
+		}
+	} else if kind == reflect.Int ||
+		kind == reflect.Int8 ||
+		kind == reflect.Int16 ||
+		kind == reflect.Int32 ||
+		kind == reflect.Int64 {
+		var v int64
+		v, err = strconv.ParseInt(strField, 0, field.Type().Bits())
+		if err == nil {
+			field.SetInt(v)
+		}
+	} else if kind == reflect.Uint ||
+		kind == reflect.Uint8 ||
+		kind == reflect.Uint16 ||
+		kind == reflect.Uint32 ||
+		kind == reflect.Uint64 {
+		var v uint64
+		v, err = strconv.ParseUint(strField, 0, field.Type().Bits())
+		if err == nil {
+			field.SetUint(v)
+		}
+	} else if kind == reflect.Float32 ||
+		kind == reflect.Float64 {
+		var v float64
+		v, err = strconv.ParseFloat(strField, field.Type().Bits())
+		if err == nil {
+			field.SetFloat(v)
+		}
+	} else if kind == reflect.String {
+		field.SetString(strField)
+	} else if kind == reflect.Struct ||
+		kind == reflect.Array ||
+		kind == reflect.Slice ||
+		kind == reflect.Map {
+		err = json.Unmarshal([]byte(strField), field.Addr().Interface())
+	}
+
+	return err
+}
+
+func (rf *RecordFile) newTable(name string, records []interface{}) (*table, error) {
+	typeRecord := rf.typeRecord
 
-			// indexes
-			if f.Tag == "index" {
-				index := indexes[iIndex]
-				iIndex++
-				if _, ok := index[field.Interface()]; ok {
-					return fmt.Errorf("index error: duplicate at (row=%v, col=%v)",
-						n, i)
-				}
-				index[field.Interface()] = records[n-1]
+	// make indexes
+	indexes := []Index{}
+	for i := 0; i < typeRecord.NumField(); i++ {
+		tag := typeRecord.Field(i).Tag
+		if tag == "index" {
+			indexes = append(indexes, make(Index))
+		}
+	}
+
+	for n, r := range records {
+		record := reflect.ValueOf(r).Elem()
+
+		iIndex := 0
+		for i := 0; i < typeRecord.NumField(); i++ {
+			if typeRecord.Field(i).Tag != "index" {
+				continue
+			}
+
+			field := record.Field(i)
+			index := indexes[iIndex]
+			iIndex++
+			if _, ok := index[field.Interface()]; ok {
+				return nil, fmt.Errorf("index error: duplicate at (row=%v, col=%v)",
+					rf.row(n), rf.col(i))
 			}
+			index[field.Interface()] = r
 		}
 	}
 
-	rf.records = records
-	rf.indexes = indexes
+	// named indexes
+	named := make(map[string]namedIndex, len(rf.indexDefs))
+	for _, def := range rf.indexDefs {
+		index := make(namedIndex)
+		for n, r := range records {
+			key := def.recordKey(reflect.ValueOf(r).Elem())
+			if def.unique && len(index[key]) > 0 {
+				return nil, fmt.Errorf("index %v error: duplicate at (row=%v)",
+					def.name, rf.row(n))
+			}
+			index[key] = append(index[key], r)
+		}
+		named[def.name] = index
+	}
 
-	return nil
+	return &table{file: name, records: records, indexes: indexes, named: named}, nil
+}
+
+// a RecordFile holding the current records, which Read and a reload do not
+// replace. Record and NumRecord each see the records current at the call,
+// iterating while rf may be reloaded must be done on a snapshot
+//
+// goroutine safe
+func (rf *RecordFile) Snapshot() *RecordFile {
+	return rf.clone(rf.load())
 }
 
 func (rf *RecordFile) Record(i int) interface{} {
-	return rf.records[i]
+	return rf.load().records[i]
 }
 
 func (rf *RecordFile) NumRecord() int {
-	return len(rf.records)
+	return len(rf.load().records)
 }
 
 func (rf *RecordFile) Indexes(i int) Index {
-	if i >= len(rf.indexes) {
+	t := rf.load()
+	if i >= len(t.indexes) {
 		return nil
 	}
-	return rf.indexes[i]
+	return t.indexes[i]
 }
 
 func (rf *RecordFile) Index(i interface{}) interface{} {
@@ -0,0 +1,188 @@
+package recordfile
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// references to other tables are declared by the ref tag:
+//
+//	ItemID  int   `ref:"Item.ID"`
+//	ItemIDs []int `ref:"Item.ID,omitempty"`
+//
+// every element of a slice or array field is checked,
+// omitempty skips zero values
+type refDef struct {
+	field     int
+	table     string
+	column    string
+	omitEmpty bool
+}
+
+func parseRefDefs(typeRecord reflect.Type) ([]*refDef, error) {
+	var defs []*refDef
+	for i := 0; i < typeRecord.NumField(); i++ {
+		f := typeRecord.Field(i)
+		tag := f.Tag.Get("ref")
+		if tag == "" {
+			continue
+		}
+
+		opts := strings.Split(tag, ",")
+		target := strings.SplitN(opts[0], ".", 2)
+		if len(target) != 2 || target[0] == "" || target[1] == "" {
+			return nil, fmt.Errorf("field %v: invalid ref %v", f.Name, tag)
+		}
+		def := &refDef{field: i, table: target[0], column: target[1]}
+		for _, opt := range opts[1:] {
+			if opt != "omitempty" {
+				return nil, fmt.Errorf("field %v: invalid ref option %v", f.Name, opt)
+			}
+			def.omitEmpty = true
+		}
+
+		t := f.Type
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Struct, reflect.Slice, reflect.Array, reflect.Map:
+			return nil, fmt.Errorf("could not ref %s field %v %v", f.Type.Kind(), i, f.Name)
+		}
+
+		defs = append(defs, def)
+	}
+	return defs, nil
+}
+
+// the row of the record n as in the parse errors, the header row is 0
+func (rf *RecordFile) row(n int) int {
+	if rf.HeaderRows <= 0 {
+		return n + 1
+	}
+	return n + rf.HeaderRows
+}
+
+// the column of the field i, its header name if ByHeader is set
+func (rf *RecordFile) col(i int) interface{} {
+	if rf.ByHeader {
+		return rf.colDefs[i].name
+	}
+	return i
+}
+
+// tables are keyed by the names used in ref tags, every dangling
+// reference is reported with its file, row and column
+func CheckRefs(tables map[string]*RecordFile) error {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []string
+	columns := make(map[string]map[interface{}]struct{})
+	for _, name := range names {
+		rf := tables[name]
+		t := rf.load()
+
+		for _, def := range rf.refDefs {
+			fieldName := rf.typeRecord.Field(def.field).Name
+			target := tables[def.table]
+			if target == nil {
+				errs = append(errs, fmt.Sprintf("%v: field %v: table %v not found",
+					t.file, fieldName, def.table))
+				continue
+			}
+			column, ok := target.typeRecord.FieldByName(def.column)
+			if !ok || len(column.Index) != 1 {
+				errs = append(errs, fmt.Sprintf("%v: field %v: column %v.%v not found",
+					t.file, fieldName, def.table, def.column))
+				continue
+			}
+
+			key := def.table + "." + def.column
+			values := columns[key]
+			if values == nil {
+				values = make(map[interface{}]struct{})
+				for _, r := range target.load().records {
+					values[reflect.ValueOf(r).Elem().Field(column.Index[0]).Interface()] = struct{}{}
+				}
+				columns[key] = values
+			}
+
+			for n, r := range t.records {
+				v := reflect.ValueOf(r).Elem().Field(def.field)
+				elems := []reflect.Value{v}
+				if v.Kind() == reflect.Slice || v.Kind() == reflect.Array {
+					elems = elems[:0]
+					for i := 0; i < v.Len(); i++ {
+						elems = append(elems, v.Index(i))
+					}
+				}
+
+				for _, e := range elems {
+					if def.omitEmpty && e.IsZero() {
+						continue
+					}
+					if !e.Type().ConvertibleTo(column.Type) {
+						errs = append(errs, fmt.Sprintf("%v (row=%v, col=%v): %v is not convertible to %v.%v",
+							t.file, rf.row(n), rf.col(def.field), e.Type(), def.table, def.column))
+						break
+					}
+					if _, ok := values[e.Convert(column.Type).Interface()]; !ok {
+						errs = append(errs, fmt.Sprintf("%v (row=%v, col=%v): %v %v not found in %v.%v",
+							t.file, rf.row(n), rf.col(def.field), fieldName, e.Interface(), def.table, def.column))
+					}
+				}
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// Loader reads a set of tables, checks the references between them and
+// replaces the records of all the tables only if everything is valid, it is
+// a Reloader validated by CheckRefs
+type Loader struct {
+	r *Reloader
+	// file name -> table name
+	tables map[string]string
+}
+
+func NewLoader() *Loader {
+	l := new(Loader)
+	l.r = NewReloader()
+	l.tables = make(map[string]string)
+	l.r.Validate = func(files map[string]*RecordFile) error {
+		tables := make(map[string]*RecordFile, len(files))
+		for name, rf := range files {
+			tables[l.tables[name]] = rf
+		}
+		return CheckRefs(tables)
+	}
+	return l
+}
+
+// table is the name used in ref tags
+func (l *Loader) Add(table string, rf *RecordFile, name string) {
+	l.tables[name] = table
+	l.r.Add(rf, name)
+}
+
+func (l *Loader) Load() error {
+	return l.r.Reload()
+}
+
+// the Reloader of the tables, to Watch or Notify, its Validate must not be
+// replaced
+func (l *Loader) Reloader() *Reloader {
+	return l.r
+}
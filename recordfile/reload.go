@@ -0,0 +1,203 @@
+package recordfile
+
+import (
+	"fmt"
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/console"
+	"github.com/name5566/leaf/log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reloader re-reads a set of record files together. Every file is parsed
+// and validated before any of them is replaced, the servers added by Notify
+// are then called with "ReloadRecordFiles" and the names of the files.
+//
+// Each RecordFile added is replaced on its own, a reader using several files,
+// or iterating over one, must take a Snapshot which is replaced as a whole
+type Reloader struct {
+	// called with the new, not yet installed, files keyed by name
+	Validate func(files map[string]*RecordFile) error
+
+	mutex    sync.Mutex
+	files    map[string]*RecordFile
+	modTimes map[string]time.Time
+	servers  []*chanrpc.Server
+	closeSig chan bool
+	wg       sync.WaitGroup
+	// map[string]*RecordFile of snapshots, replaced as a whole
+	snapshot atomic.Value
+}
+
+func NewReloader() *Reloader {
+	r := new(Reloader)
+	r.files = make(map[string]*RecordFile)
+	r.modTimes = make(map[string]time.Time)
+	r.snapshot.Store(map[string]*RecordFile{})
+	return r
+}
+
+// goroutine safe
+func (r *Reloader) Add(rf *RecordFile, name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.files[name] = rf
+	if fi, err := os.Stat(name); err == nil {
+		r.modTimes[name] = fi.ModTime()
+	}
+
+	old := r.Snapshot()
+	snapshot := make(map[string]*RecordFile, len(old)+1)
+	for n, f := range old {
+		snapshot[n] = f
+	}
+	snapshot[name] = rf.Snapshot()
+	r.snapshot.Store(snapshot)
+}
+
+// the files keyed by name as of the last reload, all of them from the same
+// one, the map and the files must not be modified
+//
+// goroutine safe
+func (r *Reloader) Snapshot() map[string]*RecordFile {
+	return r.snapshot.Load().(map[string]*RecordFile)
+}
+
+// goroutine safe
+func (r *Reloader) Notify(server *chanrpc.Server) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.servers = append(r.servers, server)
+}
+
+// goroutine safe
+func (r *Reloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.reload()
+}
+
+func (r *Reloader) reload() error {
+	tables := make(map[string]*table, len(r.files))
+	files := make(map[string]*RecordFile, len(r.files))
+	var errs []string
+	for name, rf := range r.files {
+		t, err := rf.read(name)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+			continue
+		}
+		tables[name] = t
+
+		files[name] = rf.clone(t)
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("reload error: %v", strings.Join(errs, "; "))
+	}
+
+	if r.Validate != nil {
+		if err := r.Validate(files); err != nil {
+			return fmt.Errorf("reload error: %v", err)
+		}
+	}
+
+	r.snapshot.Store(files)
+	names := make([]string, 0, len(tables))
+	for name, t := range tables {
+		r.files[name].table.Store(t)
+		if fi, err := os.Stat(name); err == nil {
+			r.modTimes[name] = fi.ModTime()
+		}
+		names = append(names, name)
+	}
+	for _, server := range r.servers {
+		server.Go("ReloadRecordFiles", names)
+	}
+
+	log.Release("record files reloaded: %v", strings.Join(names, ", "))
+	return nil
+}
+
+func (r *Reloader) changed() bool {
+	for name := range r.files {
+		fi, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		if !fi.ModTime().Equal(r.modTimes[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+// polls the modification time of the files and reloads all of them
+// when one changes
+func (r *Reloader) Watch(interval time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closeSig != nil {
+		return
+	}
+	closeSig := make(chan bool)
+	r.closeSig = closeSig
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-closeSig:
+				return
+			case <-t.C:
+			}
+
+			r.mutex.Lock()
+			if r.changed() {
+				if err := r.reload(); err != nil {
+					log.Error("%v", err)
+					// wait for the next change
+					for name := range r.files {
+						if fi, err := os.Stat(name); err == nil {
+							r.modTimes[name] = fi.ModTime()
+						}
+					}
+				}
+			}
+			r.mutex.Unlock()
+		}
+	}()
+}
+
+func (r *Reloader) Close() {
+	r.mutex.Lock()
+	closeSig := r.closeSig
+	r.closeSig = nil
+	r.mutex.Unlock()
+
+	if closeSig != nil {
+		close(closeSig)
+		r.wg.Wait()
+	}
+}
+
+// you must call the function before calling console.Init
+func (r *Reloader) RegisterCommand(name string) {
+	console.RegisterFunc(name, "reload the record files", func([]string) string {
+		if err := r.Reload(); err != nil {
+			return err.Error()
+		}
+		return "ok"
+	})
+}
@@ -0,0 +1,216 @@
+package recordfile
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// XLSXReader reads a sheet of an Excel workbook, rows are parsed like the
+// lines of a CSV file: the first one is the header, rows whose first cell
+// starts with RecordFile.Comment and empty rows are skipped
+type XLSXReader struct {
+	// empty means the first sheet
+	Sheet string
+}
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		ID   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t *xlsxText) String() string {
+	if len(t.Runs) == 0 {
+		return t.T
+	}
+	var s strings.Builder
+	for _, r := range t.Runs {
+		s.WriteString(r.T)
+	}
+	return s.String()
+}
+
+type xlsxSharedStrings struct {
+	Items []xlsxText `xml:"si"`
+}
+
+type xlsxWorksheet struct {
+	Rows []struct {
+		Cells []struct {
+			Ref    string   `xml:"r,attr"`
+			Type   string   `xml:"t,attr"`
+			Value  string   `xml:"v"`
+			Inline xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+func (r XLSXReader) ReadRecords(rf *RecordFile, name string) ([]interface{}, error) {
+	if rf.Comment == 0 {
+		rf.Comment = Comment
+	}
+
+	rows, err := r.readRows(name)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([][]string, 0, len(rows))
+	for _, row := range rows {
+		if len(row) == 0 || strings.HasPrefix(row[0], string(rf.Comment)) {
+			continue
+		}
+		lines = append(lines, row)
+	}
+	return rf.ParseRows(lines)
+}
+
+func (r XLSXReader) readRows(name string) ([][]string, error) {
+	z, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+
+	files := make(map[string]*zip.File)
+	for _, f := range z.File {
+		files[f.Name] = f
+	}
+	decode := func(name string, v interface{}) error {
+		f := files[name]
+		if f == nil {
+			return fmt.Errorf("%v not found", name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		return xml.NewDecoder(rc).Decode(v)
+	}
+
+	// sheet
+	var workbook xlsxWorkbook
+	if err := decode("xl/workbook.xml", &workbook); err != nil {
+		return nil, err
+	}
+	var sheetID string
+	for _, sheet := range workbook.Sheets {
+		if r.Sheet == "" || sheet.Name == r.Sheet {
+			sheetID = sheet.ID
+			break
+		}
+	}
+	if sheetID == "" {
+		return nil, fmt.Errorf("sheet %v not found", r.Sheet)
+	}
+
+	var rels xlsxRelationships
+	if err := decode("xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+	var sheetName string
+	for _, rel := range rels.Relationships {
+		if rel.ID == sheetID {
+			if strings.HasPrefix(rel.Target, "/") {
+				sheetName = strings.TrimPrefix(rel.Target, "/")
+			} else {
+				sheetName = path.Join("xl", rel.Target)
+			}
+			break
+		}
+	}
+	if sheetName == "" {
+		return nil, fmt.Errorf("sheet %v not found", r.Sheet)
+	}
+
+	// shared strings are optional
+	var sst xlsxSharedStrings
+	if files["xl/sharedStrings.xml"] != nil {
+		if err := decode("xl/sharedStrings.xml", &sst); err != nil {
+			return nil, err
+		}
+	}
+
+	var ws xlsxWorksheet
+	if err := decode(sheetName, &ws); err != nil {
+		return nil, err
+	}
+
+	rows := make([][]string, 0, len(ws.Rows))
+	width := 0
+	for _, row := range ws.Rows {
+		var cells []string
+		for i, c := range row.Cells {
+			col := i
+			if c.Ref != "" {
+				col = column(c.Ref)
+			}
+			for len(cells) <= col {
+				cells = append(cells, "")
+			}
+
+			switch c.Type {
+			case "s":
+				var n int
+				if _, err := fmt.Sscan(c.Value, &n); err != nil || n < 0 || n >= len(sst.Items) {
+					return nil, fmt.Errorf("cell %v: invalid shared string %v", c.Ref, c.Value)
+				}
+				cells[col] = sst.Items[n].String()
+			case "inlineStr":
+				cells[col] = c.Inline.String()
+			default:
+				cells[col] = c.Value
+			}
+		}
+
+		// trailing empty cells are not significant
+		for len(cells) > 0 && cells[len(cells)-1] == "" {
+			cells = cells[:len(cells)-1]
+		}
+		if len(cells) > width {
+			width = len(cells)
+		}
+		rows = append(rows, cells)
+	}
+
+	for i := range rows {
+		if len(rows[i]) == 0 {
+			continue
+		}
+		for len(rows[i]) < width {
+			rows[i] = append(rows[i], "")
+		}
+	}
+	return rows, nil
+}
+
+// "AB12" -> 27
+func column(ref string) int {
+	n := 0
+	for _, c := range ref {
+		if c < 'A' || c > 'Z' {
+			break
+		}
+		n = n*26 + int(c-'A') + 1
+	}
+	return n - 1
+}
@@ -3,6 +3,7 @@ package timer
 import (
 	"github.com/name5566/leaf/conf"
 	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/metrics"
 	"runtime"
 	"time"
 )
@@ -11,23 +12,36 @@ import (
 // Timer主要是提供一个Cron功能的定时器服务，其中Timer是time.AfterFunc的封装，是为了方便居合道Skeleton中。
 //
 
+var dispatchLag = metrics.NewHistogram("leaf_timer_dispatch_lag_seconds",
+	"Delay between a timer firing and its callback being run.",
+	[]float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1})
+
 // one dispatcher per goroutine (goroutine not safe)
 // 封装一个*Timer类型的通道
 type Dispatcher struct {
 	ChanTimer chan *Timer
+	closeSig  chan struct{}
 }
 // 创建一个Dispatcher对象，l为chan的缓存容量
 func NewDispatcher(l int) *Dispatcher {
 	disp := new(Dispatcher)
 	disp.ChanTimer = make(chan *Timer, l)
+	disp.closeSig = make(chan struct{})
 	return disp
 }
 
+// 关闭后触发的定时器会被丢弃，而不会在ChanTimer已满时一直阻塞，只能调用一次
+// goroutine safe
+func (disp *Dispatcher) Close() {
+	close(disp.closeSig)
+}
+
 // Timer
 // 封装了标准库中的Timer，加上了一个回调函数cb
 type Timer struct {
-	t  *time.Timer
-	cb func()
+	t     *time.Timer
+	cb    func()
+	fired time.Time
 }
 // 停止t timer，并将cb置空
 func (t *Timer) Stop() {
@@ -50,6 +64,9 @@ func (t *Timer) Cb() {
 		}
 	}()
 
+	if !t.fired.IsZero() {
+		dispatchLag.Observe(time.Since(t.fired).Seconds())
+	}
 	if t.cb != nil {
 		t.cb()
 	}
@@ -60,7 +77,11 @@ func (disp *Dispatcher) AfterFunc(d time.Duration, cb func()) *Timer {
 	t := new(Timer)
 	t.cb = cb
 	t.t = time.AfterFunc(d, func() {
-		disp.ChanTimer <- t
+		t.fired = time.Now()
+		select {
+		case disp.ChanTimer <- t:
+		case <-disp.closeSig:
+		}
 	})
 	return t
 }